@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bnema/xtrayhide/internal/control"
+	"github.com/bnema/xtrayhide/internal/sni"
+)
+
+func connectDaemon() (*control.Client, func(), error) {
+	bus, err := sni.Connect()
+	if err != nil {
+		return nil, nil, err
+	}
+	return control.NewClient(bus), func() { bus.Close() }, nil
+}
+
+func runList(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print icons as JSON")
+	fs.Parse(args)
+
+	client, closeBus, err := connectDaemon()
+	if err != nil {
+		return err
+	}
+	defer closeBus()
+	icons, err := client.ListIcons()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(icons)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tWINDOW\tCLASS\tPID\tSTATUS\tCAPTURED\tTITLE")
+	for _, icon := range icons {
+		id := icon.ID
+		if id == "" {
+			id = "-"
+		}
+		captured := "-"
+		if icon.LastCapture > 0 {
+			captured = time.UnixMilli(icon.LastCapture).Format(time.TimeOnly)
+		}
+		fmt.Fprintf(w, "%s\t0x%x\t%s\t%d\t%s\t%s\t%s\n", id, icon.Window, icon.Class, icon.PID, icon.Status, captured, icon.Title)
+	}
+	return w.Flush()
+}
+
+func runClick(args []string) error {
+	fs := flag.NewFlagSet("click", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return errors.New("usage: xtrayhide click <icon> [button]")
+	}
+	button := uint64(1)
+	if fs.NArg() == 2 {
+		var err error
+		button, err = strconv.ParseUint(fs.Arg(1), 10, 8)
+		if err != nil || button == 0 {
+			return fmt.Errorf("invalid button %q", fs.Arg(1))
+		}
+	}
+
+	client, closeBus, err := connectDaemon()
+	if err != nil {
+		return err
+	}
+	defer closeBus()
+	return client.Click(fs.Arg(0), uint8(button))
+}
+
+func runCapture(args []string) error {
+	fs := flag.NewFlagSet("capture", flag.ExitOnError)
+	output := fs.String("o", "", "output PNG file")
+	icon := ""
+	// Accept the icon before the flags, as in "capture <icon> -o icon.png".
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		icon, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	if icon == "" {
+		icon = fs.Arg(0)
+	}
+	if icon == "" || *output == "" {
+		return errors.New("usage: xtrayhide capture <icon> -o <file>")
+	}
+
+	client, closeBus, err := connectDaemon()
+	if err != nil {
+		return err
+	}
+	defer closeBus()
+	data, err := client.Capture(icon)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(*output, data, 0o644)
+}
+
+func runReload(args []string) error {
+	fs := flag.NewFlagSet("reload", flag.ExitOnError)
+	fs.Parse(args)
+
+	client, closeBus, err := connectDaemon()
+	if err != nil {
+		return err
+	}
+	defer closeBus()
+	return client.Reload()
+}
+
+func runStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print status as JSON")
+	fs.Parse(args)
+
+	client, closeBus, err := connectDaemon()
+	if err != nil {
+		return err
+	}
+	defer closeBus()
+	status, err := client.Status()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(status)
+	}
+	fmt.Printf("pid:     %d\n", status.PID)
+	fmt.Printf("uptime:  %s\n", time.Duration(status.Uptime)*time.Second)
+	fmt.Printf("icons:   %d (%d bridged)\n", status.Icons, status.Bridged)
+	fmt.Printf("config:  %s\n", status.Config)
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/bnema/xtrayhide/internal/config"
+	"github.com/bnema/xtrayhide/internal/logging"
+	"github.com/bnema/xtrayhide/internal/systemd"
+	"github.com/bnema/xtrayhide/pkg/bridge"
+)
+
+func runDaemon(args []string) error {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	cfgPath := fs.String("config", config.DefaultPath(), "path to the configuration file")
+	dumpDir := fs.String("dump-dir", "", "write every capture and converted pixmap as PNG into `dir`")
+	dumpOnce := fs.Bool("dump-once", false, "capture all docked icons into the dump directory and exit")
+	replace := fs.Bool("replace", false, "take over the icons of a running instance without making clients re-dock")
+	noSNI := fs.Bool("no-sni", false, "do not export icons as StatusNotifierItems")
+	jsonStdout := fs.Bool("json", false, "stream icons as JSON lines on stdout and read commands from stdin")
+	jsonSocket := fs.String("json-socket", "", "stream icons as JSON lines to clients of the Unix socket at `path`")
+	jsonImages := fs.String("json-images", "", "write JSON icon captures as PNG files into `dir` instead of inlining them")
+	logFlags := addLogFlags(fs)
+	fs.Parse(args)
+	if *dumpOnce && *dumpDir == "" {
+		*dumpDir = "."
+	}
+
+	if err := logFlags.setup(); err != nil {
+		return err
+	}
+	slog.Info("xtrayhide starting - capturing and hiding X11 tray icons")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// systemctl status follows the icons as they are bridged.
+	var b *bridge.Bridge
+	status := func(*bridge.Icon) { notifyStatus(b) }
+	sinks := []bridge.Sink{bridge.Callbacks{Added: status, Removed: status}}
+	if !*noSNI {
+		sinks = append(sinks, bridge.SNI())
+	}
+	if *jsonStdout || *jsonSocket != "" {
+		sink, err := jsonSink(*jsonStdout, *jsonSocket, *jsonImages)
+		if err != nil {
+			return err
+		}
+		defer sink.Close()
+		sinks = append(sinks, sink)
+	}
+	b, err := bridge.New(bridge.Options{
+		ConfigPath:  *cfgPath,
+		Sinks:       sinks,
+		Replace:     *replace,
+		Handoff:     !*dumpOnce,
+		Control:     !*dumpOnce,
+		WatchConfig: true,
+		DumpDir:     *dumpDir,
+		OnReady: func() {
+			notifyStatus(b)
+			if err := systemd.Notify(systemd.Ready); err != nil {
+				slog.Warn("notify systemd", "err", err)
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if *dumpOnce {
+		count, err := b.DumpDocked(ctx)
+		if err != nil {
+			return err
+		}
+		slog.Info("dumped icons", "count", count)
+		return nil
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for range hup {
+			reloadConfig(b)
+		}
+	}()
+
+	if interval, ok := systemd.WatchdogInterval(); ok {
+		go watchdog(ctx, b, interval)
+	}
+	err = b.Run(ctx)
+	systemd.Notify(systemd.Stopping)
+	return err
+}
+
+// jsonSink sets up the JSON output on stdout and stdin, on a Unix socket, or
+// both.
+func jsonSink(stdout bool, socket, images string) (*bridge.JSONSink, error) {
+	sink, err := bridge.NewJSON(bridge.JSONOptions{ImageDir: images})
+	if err != nil {
+		return nil, err
+	}
+	if stdout {
+		sink.Attach(os.Stdin, os.Stdout)
+	}
+	if socket != "" {
+		if err := sink.Listen(socket); err != nil {
+			return nil, err
+		}
+		slog.Info("json output available", "socket", socket)
+	}
+	return sink, nil
+}
+
+// notifyStatus reports the icon counts to systemd.
+func notifyStatus(b *bridge.Bridge) {
+	docked, bridged := b.Counts()
+	systemd.Notify(systemd.Status("%d icons docked, %d bridged", docked, bridged))
+}
+
+// watchdog pings systemd while both the X event loop and the bridge loop keep
+// dispatching. A hung X connection or bridge stops the pings and lets systemd
+// restart the service.
+func watchdog(ctx context.Context, b *bridge.Bridge, interval time.Duration) {
+	ticker := time.NewTicker(interval / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if err := b.Ping(interval / 3); err != nil {
+			slog.Warn("watchdog: bridge unresponsive", "err", err)
+			continue
+		}
+		systemd.Notify(systemd.Watchdog)
+	}
+}
+
+type logFlags struct {
+	level  *string
+	format *string
+}
+
+func addLogFlags(fs *flag.FlagSet) logFlags {
+	return logFlags{
+		level:  fs.String("log-level", "info", "minimum log level: debug, info, warn or error"),
+		format: fs.String("log-format", logging.FormatAuto, "log format: text, json or journal (default: journal under systemd, text otherwise)"),
+	}
+}
+
+// setup installs the logger selected by the flags as the slog default.
+func (f logFlags) setup() error {
+	logger, err := logging.New(os.Stderr, *f.level, *f.format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// reloadConfig applies the config file to the running bridge, keeping the
+// current one when it does not load.
+func reloadConfig(b *bridge.Bridge) {
+	if err := b.Reload(); err != nil {
+		slog.Error("config reload failed, keeping previous config", "err", err)
+		return
+	}
+	notifyStatus(b)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/godbus/dbus/v5"
+
+	"github.com/bnema/xtrayhide/internal/icontheme"
+	"github.com/bnema/xtrayhide/internal/sni"
+	"github.com/bnema/xtrayhide/internal/tray"
+)
+
+// Scroll steps sent for wheel clicks, in the 1/8 degree units used by Qt and
+// Plasma.
+const scrollStep = 120
+
+// reverseItem is an SNI item hosted as an XEmbed icon.
+type reverseItem struct {
+	addr   string
+	remote *sni.RemoteItem
+	dock   *tray.DockIcon
+
+	mu         sync.Mutex
+	itemIsMenu bool
+}
+
+// reverseBridge docks the SNI items of the session into an X11 system tray.
+type reverseBridge struct {
+	docker *tray.Docker
+	bus    *dbus.Conn
+	items  map[string]*reverseItem
+}
+
+func runReverse(args []string) error {
+	fs := flag.NewFlagSet("reverse", flag.ExitOnError)
+	logFlags := addLogFlags(fs)
+	fs.Parse(args)
+	if err := logFlags.setup(); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	docker, err := tray.NewDocker()
+	if err != nil {
+		return fmt.Errorf("x11: %w", err)
+	}
+	defer docker.Conn.Close()
+	if !docker.HasTray() {
+		slog.Info("no system tray running, icons will dock once one starts")
+	}
+
+	// Applications only publish SNI items when a watcher exists, which
+	// X11 panels usually do not provide.
+	if watcherBus, err := sni.Connect(); err != nil {
+		return fmt.Errorf("dbus session bus: %w", err)
+	} else if _, err := sni.NewWatcher(watcherBus); err != nil {
+		watcherBus.Close()
+		if !errors.Is(err, sni.ErrWatcherRunning) {
+			return fmt.Errorf("start watcher: %w", err)
+		}
+	} else {
+		defer watcherBus.Close()
+		slog.Info("started StatusNotifierWatcher")
+	}
+
+	bus, err := sni.Connect()
+	if err != nil {
+		return fmt.Errorf("dbus session bus: %w", err)
+	}
+	defer bus.Close()
+	host, err := sni.NewHost(bus)
+	if err != nil {
+		return fmt.Errorf("status notifier host: %w", err)
+	}
+
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+	go func() {
+		if err := docker.Run(runCtx); err != nil {
+			slog.Error("x11 event loop stopped", "err", err)
+			stop()
+		}
+	}()
+
+	r := &reverseBridge{docker: docker, bus: bus, items: make(map[string]*reverseItem)}
+	items, err := host.Items()
+	if err != nil {
+		return err
+	}
+	for _, addr := range items {
+		r.add(addr)
+	}
+
+	events := host.Events()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				r.close()
+				return fmt.Errorf("session bus connection closed")
+			}
+			switch ev.Kind {
+			case sni.ItemAdded:
+				r.add(ev.Item)
+			case sni.ItemRemoved:
+				r.remove(ev.Item)
+			case sni.ItemChanged:
+				if item, ok := r.items[ev.Item]; ok {
+					r.update(item)
+				}
+			}
+
+		case <-ctx.Done():
+			r.close()
+			return nil
+		}
+	}
+}
+
+func (r *reverseBridge) add(addr string) {
+	if _, ok := r.items[addr]; ok {
+		return
+	}
+	slog.Info("item registered", "item", addr)
+	item := &reverseItem{addr: addr, remote: sni.NewRemoteItem(r.bus, addr)}
+	r.items[addr] = item
+	r.update(item)
+}
+
+func (r *reverseBridge) remove(addr string) {
+	item, ok := r.items[addr]
+	if !ok {
+		return
+	}
+	slog.Info("item unregistered", "item", addr)
+	if item.dock != nil {
+		item.dock.Close()
+	}
+	delete(r.items, addr)
+}
+
+func (r *reverseBridge) close() {
+	for addr := range r.items {
+		r.remove(addr)
+	}
+	r.docker.Close()
+}
+
+// update docks, repaints or hides the icon of item after its properties
+// changed. Passive items are not shown, as SNI hosts do.
+func (r *reverseBridge) update(item *reverseItem) {
+	props, err := item.remote.Properties()
+	if err != nil {
+		slog.Warn("read item properties", "item", item.addr, "err", err)
+		return
+	}
+	if props.Status == "Passive" {
+		if item.dock != nil {
+			item.dock.Close()
+			item.dock = nil
+		}
+		return
+	}
+
+	title := props.ToolTip.Title
+	if title == "" {
+		title = props.Title
+	}
+	if title == "" {
+		title = props.ID
+	}
+	if item.dock == nil {
+		dock, err := r.docker.NewIcon(title)
+		if err != nil {
+			slog.Warn("create tray icon", "item", item.addr, "err", err)
+			return
+		}
+		dock.SetClickHandler(item.clicked)
+		item.dock = dock
+	} else {
+		item.dock.SetTitle(title)
+	}
+	item.mu.Lock()
+	item.itemIsMenu = props.ItemIsMenu
+	item.mu.Unlock()
+	item.dock.SetImage(itemImage(props))
+}
+
+// clicked forwards a click on the docked icon to the item.
+func (item *reverseItem) clicked(button uint8, x, y int16) {
+	item.mu.Lock()
+	isMenu := item.itemIsMenu
+	item.mu.Unlock()
+	px, py := int32(x), int32(y)
+	switch button {
+	case 1:
+		if isMenu {
+			item.remote.ContextMenu(px, py)
+		} else {
+			item.remote.Activate(px, py)
+		}
+	case 2:
+		item.remote.SecondaryActivate(px, py)
+	case 3:
+		item.remote.ContextMenu(px, py)
+	case 4:
+		item.remote.Scroll(scrollStep, "vertical")
+	case 5:
+		item.remote.Scroll(-scrollStep, "vertical")
+	case 6:
+		item.remote.Scroll(-scrollStep, "horizontal")
+	case 7:
+		item.remote.Scroll(scrollStep, "horizontal")
+	}
+}
+
+// itemImage picks the image to paint: the largest pixmap, else the IconName
+// file or theme icon, searched in the item's IconThemePath first. The
+// attention variants are preferred while the item needs attention.
+func itemImage(props sni.Properties) image.Image {
+	pixmaps, iconName := props.IconPixmap, props.IconName
+	if props.Status == "NeedsAttention" {
+		if len(props.AttentionIconPixmap) > 0 {
+			pixmaps = props.AttentionIconPixmap
+		} else if props.AttentionIconName != "" {
+			pixmaps, iconName = nil, props.AttentionIconName
+		}
+	}
+	var best *sni.Pixmap
+	for idx := range pixmaps {
+		p := &pixmaps[idx]
+		if best == nil || p.Width*p.Height > best.Width*best.Height {
+			best = p
+		}
+	}
+	if best != nil {
+		return sni.ImageFromPixmap(*best)
+	}
+	if strings.Contains(iconName, "/") {
+		if _, images, err := icontheme.Resolve(iconName); err == nil && len(images) > 0 {
+			return images[0]
+		}
+	} else if iconName != "" {
+		if images := icontheme.Render(icontheme.Current(), iconName, icontheme.DefaultSizes, props.IconThemePath); len(images) > 0 {
+			return images[len(images)-1]
+		}
+	}
+	return nil
+}
@@ -3,8 +3,9 @@ module github.com/bnema/xtrayhide
 go 1.25.6
 
 require (
+	github.com/BurntSushi/toml v1.5.0
 	github.com/godbus/dbus/v5 v5.2.2
 	github.com/jezek/xgb v1.2.0
 )
 
-require golang.org/x/sys v0.27.0 // indirect
+require golang.org/x/sys v0.27.0
@@ -0,0 +1,300 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	ActionBridge = "bridge"
+	ActionIgnore = "ignore"
+
+	CaptureWindow = "window"
+	CaptureStatic = "static"
+
+	InputSendEvent = "send-event"
+	InputXTest     = "xtest"
+
+	GeometryClient = "client"
+	GeometryFixed  = "fixed"
+
+	ActivateClick  = "click"
+	ActivateRaise  = "raise"
+	ActivateToggle = "toggle"
+
+	// MaxSlotSize bounds slot and capture sizes.
+	MaxSlotSize = 512
+
+	defaultCategory    = "ApplicationStatus"
+	defaultSlotSize    = 32
+	defaultHookTimeout = 30
+)
+
+type Config struct {
+	Rules []Rule `toml:"rule"`
+}
+
+// Rule changes how matching icons are exported. Every matching rule applies
+// in file order, so later rules override fields set by earlier ones.
+type Rule struct {
+	Match        Match   `toml:"match"`
+	Action       string  `toml:"action"`
+	Category     string  `toml:"category"`
+	ID           string  `toml:"id"`
+	Title        string  `toml:"title"`
+	Icon         string  `toml:"icon"`
+	SlotSize     int     `toml:"slot_size"`
+	CaptureSizes []int   `toml:"capture_sizes"`
+	Geometry     string  `toml:"geometry"`
+	Aspect       float64 `toml:"aspect"`
+	Capture      string  `toml:"capture"`
+	Input        string  `toml:"input"`
+	Activate     string  `toml:"activate"`
+	Buttons      Buttons `toml:"buttons"`
+	Hooks        Hooks   `toml:"hooks"`
+}
+
+// Match selects icons. All set fields must match; a rule without any field
+// matches every icon.
+type Match struct {
+	// Class matches the WM_CLASS instance or class name, case-insensitively.
+	Class string `toml:"class"`
+	// Title is a regular expression matched against the icon title.
+	Title string `toml:"title"`
+	// Executable matches the full path or the base name of the process.
+	Executable string `toml:"executable"`
+	// DesktopID matches the .desktop file id, with or without the suffix.
+	DesktopID string `toml:"desktop_id"`
+
+	title *regexp.Regexp
+}
+
+// Buttons maps SNI actions to the X button sent to the icon.
+type Buttons struct {
+	Activate          int `toml:"activate"`
+	SecondaryActivate int `toml:"secondary_activate"`
+	ContextMenu       int `toml:"context_menu"`
+}
+
+// Hooks are shell commands run when an icon docks, goes away, changes its
+// title or asks for attention.
+type Hooks struct {
+	Docked    string `toml:"docked"`
+	Removed   string `toml:"removed"`
+	Title     string `toml:"title"`
+	Attention string `toml:"attention"`
+	// Timeout is how many seconds a hook may run before it is killed.
+	Timeout int `toml:"timeout"`
+}
+
+// Target describes a docked icon for rule matching.
+type Target struct {
+	Instance   string
+	Class      string
+	Title      string
+	Executable string
+	DesktopID  string
+}
+
+// Settings is the result of applying the matching rules to a target.
+type Settings struct {
+	Ignore       bool
+	Category     string
+	ID           string
+	Title        string
+	Icon         string
+	SlotSize     int
+	CaptureSizes []int
+	Geometry     string
+	Aspect       float64
+	Capture      string
+	Input        string
+	Activate     string
+	Buttons      Buttons
+	Hooks        Hooks
+}
+
+// DefaultPath returns $XDG_CONFIG_HOME/xtrayhide/config.toml.
+func DefaultPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			dir = filepath.Join(home, ".config")
+		}
+	}
+	return filepath.Join(dir, "xtrayhide", "config.toml")
+}
+
+// Load reads and validates the config at path. A missing file yields an
+// empty config.
+func Load(path string) (*Config, error) {
+	cfg := &Config{}
+	meta, err := toml.DecodeFile(path, cfg)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("parse %s: unknown key %s", path, undecoded[0])
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("validate %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (c *Config) validate() error {
+	for idx := range c.Rules {
+		rule := &c.Rules[idx]
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("rule %d: %w", idx+1, err)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) validate() error {
+	switch r.Action {
+	case "", ActionBridge, ActionIgnore:
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	switch r.Capture {
+	case "", CaptureWindow, CaptureStatic:
+	default:
+		return fmt.Errorf("unknown capture mode %q", r.Capture)
+	}
+	switch r.Input {
+	case "", InputSendEvent, InputXTest:
+	default:
+		return fmt.Errorf("unknown input method %q", r.Input)
+	}
+	if r.SlotSize < 0 || r.SlotSize > MaxSlotSize {
+		return fmt.Errorf("slot_size %d out of range", r.SlotSize)
+	}
+	switch r.Activate {
+	case "", ActivateClick, ActivateRaise, ActivateToggle:
+	default:
+		return fmt.Errorf("unknown activate mode %q", r.Activate)
+	}
+	switch r.Geometry {
+	case "", GeometryClient, GeometryFixed:
+	default:
+		return fmt.Errorf("unknown geometry %q", r.Geometry)
+	}
+	if r.Aspect < 0 {
+		return fmt.Errorf("aspect %g must not be negative", r.Aspect)
+	}
+	for _, size := range r.CaptureSizes {
+		if size <= 0 || size > MaxSlotSize {
+			return fmt.Errorf("capture size %d out of range", size)
+		}
+	}
+	for _, button := range []int{r.Buttons.Activate, r.Buttons.SecondaryActivate, r.Buttons.ContextMenu} {
+		if button < 0 || button > 255 {
+			return fmt.Errorf("button %d out of range", button)
+		}
+	}
+	if r.Hooks.Timeout < 0 {
+		return fmt.Errorf("hook timeout %d must not be negative", r.Hooks.Timeout)
+	}
+	if r.Match.Title != "" {
+		re, err := regexp.Compile(r.Match.Title)
+		if err != nil {
+			return fmt.Errorf("title pattern: %w", err)
+		}
+		r.Match.title = re
+	}
+	return nil
+}
+
+// Resolve applies the rules matching t on top of the defaults.
+func (c *Config) Resolve(t Target) Settings {
+	s := Settings{
+		Category: defaultCategory,
+		SlotSize: defaultSlotSize,
+		Geometry: GeometryClient,
+		Capture:  CaptureWindow,
+		Input:    InputSendEvent,
+		Activate: ActivateClick,
+		Buttons:  Buttons{Activate: 1, SecondaryActivate: 2, ContextMenu: 3},
+		Hooks:    Hooks{Timeout: defaultHookTimeout},
+	}
+	if c == nil {
+		return s
+	}
+	for _, rule := range c.Rules {
+		if !rule.Match.matches(t) {
+			continue
+		}
+		if rule.Action != "" {
+			s.Ignore = rule.Action == ActionIgnore
+		}
+		s.Category = override(s.Category, rule.Category)
+		s.ID = override(s.ID, rule.ID)
+		s.Title = override(s.Title, rule.Title)
+		s.Icon = override(s.Icon, rule.Icon)
+		s.Geometry = override(s.Geometry, rule.Geometry)
+		s.Capture = override(s.Capture, rule.Capture)
+		s.Input = override(s.Input, rule.Input)
+		s.Activate = override(s.Activate, rule.Activate)
+		if rule.SlotSize != 0 {
+			s.SlotSize = rule.SlotSize
+		}
+		if len(rule.CaptureSizes) > 0 {
+			s.CaptureSizes = rule.CaptureSizes
+		}
+		if rule.Aspect != 0 {
+			s.Aspect = rule.Aspect
+		}
+		if rule.Buttons.Activate != 0 {
+			s.Buttons.Activate = rule.Buttons.Activate
+		}
+		if rule.Buttons.SecondaryActivate != 0 {
+			s.Buttons.SecondaryActivate = rule.Buttons.SecondaryActivate
+		}
+		if rule.Buttons.ContextMenu != 0 {
+			s.Buttons.ContextMenu = rule.Buttons.ContextMenu
+		}
+		s.Hooks.Docked = override(s.Hooks.Docked, rule.Hooks.Docked)
+		s.Hooks.Removed = override(s.Hooks.Removed, rule.Hooks.Removed)
+		s.Hooks.Title = override(s.Hooks.Title, rule.Hooks.Title)
+		s.Hooks.Attention = override(s.Hooks.Attention, rule.Hooks.Attention)
+		if rule.Hooks.Timeout != 0 {
+			s.Hooks.Timeout = rule.Hooks.Timeout
+		}
+	}
+	return s
+}
+
+func (m Match) matches(t Target) bool {
+	if m.Class != "" && !strings.EqualFold(m.Class, t.Instance) && !strings.EqualFold(m.Class, t.Class) {
+		return false
+	}
+	if m.title != nil && !m.title.MatchString(t.Title) {
+		return false
+	}
+	if m.Executable != "" && m.Executable != t.Executable && m.Executable != filepath.Base(t.Executable) {
+		return false
+	}
+	if m.DesktopID != "" && m.DesktopID != t.DesktopID && m.DesktopID+".desktop" != t.DesktopID {
+		return false
+	}
+	return true
+}
+
+func override(current, value string) string {
+	if value != "" {
+		return value
+	}
+	return current
+}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Editors often write a file in several steps; coalesce them into one reload.
+const watchDebounce = 250 * time.Millisecond
+
+// Watch reports changes to the config file at path until ctx is done. The
+// parent directory is watched so that files replaced by rename are noticed;
+// it is created when missing, so a config written later is picked up too.
+func Watch(ctx context.Context, path string) (<-chan struct{}, error) {
+	dir, name := filepath.Split(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create config dir: %w", err)
+	}
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify init: %w", err)
+	}
+	mask := uint32(unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM)
+	if _, err := unix.InotifyAddWatch(fd, filepath.Clean(dir), mask); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("watch %s: %w", dir, err)
+	}
+	// A non-blocking descriptor lets the runtime poller interrupt Read on Close.
+	f := os.NewFile(uintptr(fd), "inotify")
+
+	changed := make(chan struct{}, 1)
+	events := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+	go func() {
+		defer close(events)
+		buf := make([]byte, 4096)
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+			if inotifyNames(buf[:n], name) {
+				events <- struct{}{}
+			}
+		}
+	}()
+	go func() {
+		defer close(changed)
+		var timer <-chan time.Time
+		for {
+			select {
+			case _, ok := <-events:
+				if !ok {
+					return
+				}
+				timer = time.After(watchDebounce)
+			case <-timer:
+				timer = nil
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changed, nil
+}
+
+// inotifyNames reports whether any event in buf concerns the file name.
+func inotifyNames(buf []byte, name string) bool {
+	for offset := 0; offset+unix.SizeofInotifyEvent <= len(buf); {
+		ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		start := offset + unix.SizeofInotifyEvent
+		end := start + int(ev.Len)
+		if end > len(buf) {
+			return false
+		}
+		if string(bytes.TrimRight(buf[start:end], "\x00")) == name {
+			return true
+		}
+		offset = end
+	}
+	return false
+}
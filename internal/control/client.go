@@ -0,0 +1,92 @@
+package control
+
+import (
+	"fmt"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// Client talks to a running daemon over the session bus.
+type Client struct {
+	obj dbus.BusObject
+}
+
+func NewClient(conn *dbus.Conn) *Client {
+	return &Client{obj: conn.Object(BusName, Path)}
+}
+
+func (c *Client) ListIcons() ([]IconInfo, error) {
+	var maps []map[string]dbus.Variant
+	if err := c.call("ListIcons").Store(&maps); err != nil {
+		return nil, fmt.Errorf("list icons: %w", err)
+	}
+	icons := make([]IconInfo, 0, len(maps))
+	for _, m := range maps {
+		icons = append(icons, IconInfo{
+			ID:          variant[string](m, "Id"),
+			Window:      variant[uint32](m, "Window"),
+			Container:   variant[uint32](m, "Container"),
+			Title:       variant[string](m, "Title"),
+			Instance:    variant[string](m, "Instance"),
+			Class:       variant[string](m, "Class"),
+			PID:         variant[uint32](m, "Pid"),
+			Service:     variant[string](m, "Service"),
+			LastCapture: variant[int64](m, "LastCapture"),
+			Status:      variant[string](m, "Status"),
+		})
+	}
+	return icons, nil
+}
+
+func (c *Client) Status() (Status, error) {
+	var m map[string]dbus.Variant
+	if err := c.call("GetStatus").Store(&m); err != nil {
+		return Status{}, fmt.Errorf("get status: %w", err)
+	}
+	return Status{
+		PID:     variant[uint32](m, "Pid"),
+		Uptime:  variant[uint64](m, "Uptime"),
+		Icons:   variant[uint32](m, "Icons"),
+		Bridged: variant[uint32](m, "Bridged"),
+		Config:  variant[string](m, "Config"),
+	}, nil
+}
+
+func (c *Client) Capture(icon string) ([]byte, error) {
+	var data []byte
+	if err := c.call("Capture", icon).Store(&data); err != nil {
+		return nil, fmt.Errorf("capture: %w", err)
+	}
+	return data, nil
+}
+
+func (c *Client) Click(icon string, button uint8) error {
+	if err := c.call("Click", icon, button).Err; err != nil {
+		return fmt.Errorf("click: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) Reload() error {
+	if err := c.call("Reload").Err; err != nil {
+		return fmt.Errorf("reload: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) call(method string, args ...any) *dbus.Call {
+	return c.obj.Call(Interface+"."+method, 0, args...)
+}
+
+func variant[T any](m map[string]dbus.Variant, key string) T {
+	var zero T
+	v, ok := m[key]
+	if !ok {
+		return zero
+	}
+	value, ok := v.Value().(T)
+	if !ok {
+		return zero
+	}
+	return value
+}
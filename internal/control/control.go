@@ -0,0 +1,170 @@
+package control
+
+import (
+	"fmt"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	BusName   = "io.github.bnema.xtrayhide"
+	Path      = dbus.ObjectPath("/io/github/bnema/xtrayhide")
+	Interface = "io.github.bnema.xtrayhide"
+)
+
+// IconInfo describes a docked icon. Icons ignored by the config have an
+// empty ID and Service.
+type IconInfo struct {
+	ID        string `json:"id"`
+	Window    uint32 `json:"window"`
+	Container uint32 `json:"container"`
+	Title     string `json:"title"`
+	Instance  string `json:"instance"`
+	Class     string `json:"class"`
+	PID       uint32 `json:"pid"`
+	Service   string `json:"service"`
+	// LastCapture is the Unix time in milliseconds of the last published
+	// capture, or 0 if none.
+	LastCapture int64  `json:"last_capture"`
+	Status      string `json:"status"`
+}
+
+// Status summarizes the running daemon.
+type Status struct {
+	PID     uint32 `json:"pid"`
+	Uptime  uint64 `json:"uptime"`
+	Icons   uint32 `json:"icons"`
+	Bridged uint32 `json:"bridged"`
+	Config  string `json:"config"`
+}
+
+// Backend is implemented by the bridge. Icons are referred to by SNI id or
+// by window id.
+type Backend interface {
+	Icons() ([]IconInfo, error)
+	Status() Status
+	Recapture(icon string) error
+	Capture(icon string) ([]byte, error)
+	Click(icon string, button uint8) error
+	ShowWindow(icon string, seconds uint32) error
+	Reload() error
+}
+
+// Server exports the control interface under BusName.
+type Server struct {
+	conn    *dbus.Conn
+	backend Backend
+}
+
+func NewServer(conn *dbus.Conn, backend Backend) (*Server, error) {
+	if conn == nil {
+		return nil, fmt.Errorf("dbus connection is nil")
+	}
+	s := &Server{conn: conn, backend: backend}
+	conn.Export(s, Path, Interface)
+	conn.Export(s, Path, "org.freedesktop.DBus.Introspectable")
+
+	reply, err := conn.RequestName(BusName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		return nil, fmt.Errorf("request name: %w", err)
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		return nil, fmt.Errorf("dbus name not available: %s", BusName)
+	}
+	return s, nil
+}
+
+func (s *Server) Close() {
+	s.conn.ReleaseName(BusName)
+}
+
+// EmitDocked signals that an icon was docked.
+func (s *Server) EmitDocked(info IconInfo) {
+	s.conn.Emit(Path, Interface+".IconDocked", info.ID, info.Window)
+}
+
+// EmitUndocked signals that an icon went away.
+func (s *Server) EmitUndocked(info IconInfo) {
+	s.conn.Emit(Path, Interface+".IconUndocked", info.ID, info.Window)
+}
+
+func (s *Server) ListIcons() ([]map[string]dbus.Variant, *dbus.Error) {
+	infos, err := s.backend.Icons()
+	if err != nil {
+		return nil, dbus.MakeFailedError(err)
+	}
+	icons := []map[string]dbus.Variant{}
+	for _, info := range infos {
+		icons = append(icons, info.toMap())
+	}
+	return icons, nil
+}
+
+func (s *Server) GetStatus() (map[string]dbus.Variant, *dbus.Error) {
+	return s.backend.Status().toMap(), nil
+}
+
+func (s *Server) Capture(icon string) ([]byte, *dbus.Error) {
+	data, err := s.backend.Capture(icon)
+	if err != nil {
+		return nil, dbus.MakeFailedError(err)
+	}
+	return data, nil
+}
+
+func (s *Server) Reload() *dbus.Error {
+	if err := s.backend.Reload(); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+func (s *Server) Recapture(icon string) *dbus.Error {
+	if err := s.backend.Recapture(icon); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+func (s *Server) Click(icon string, button byte) *dbus.Error {
+	if err := s.backend.Click(icon, button); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+func (s *Server) ShowWindow(icon string, seconds uint32) *dbus.Error {
+	if err := s.backend.ShowWindow(icon, seconds); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+func (s *Server) Introspect() (string, *dbus.Error) {
+	return introspectionXML, nil
+}
+
+func (info IconInfo) toMap() map[string]dbus.Variant {
+	return map[string]dbus.Variant{
+		"Id":          dbus.MakeVariant(info.ID),
+		"Window":      dbus.MakeVariant(info.Window),
+		"Container":   dbus.MakeVariant(info.Container),
+		"Title":       dbus.MakeVariant(info.Title),
+		"Instance":    dbus.MakeVariant(info.Instance),
+		"Class":       dbus.MakeVariant(info.Class),
+		"Pid":         dbus.MakeVariant(info.PID),
+		"Service":     dbus.MakeVariant(info.Service),
+		"LastCapture": dbus.MakeVariant(info.LastCapture),
+		"Status":      dbus.MakeVariant(info.Status),
+	}
+}
+
+func (st Status) toMap() map[string]dbus.Variant {
+	return map[string]dbus.Variant{
+		"Pid":     dbus.MakeVariant(st.PID),
+		"Uptime":  dbus.MakeVariant(st.Uptime),
+		"Icons":   dbus.MakeVariant(st.Icons),
+		"Bridged": dbus.MakeVariant(st.Bridged),
+		"Config":  dbus.MakeVariant(st.Config),
+	}
+}
@@ -0,0 +1,44 @@
+package control
+
+const introspectionXML = `<!DOCTYPE node PUBLIC "-//freedesktop//DTD D-Bus Object Introspection 1.0//EN"
+"http://www.freedesktop.org/standards/dbus/1.0/introspect.dtd">
+<node>
+  <interface name="io.github.bnema.xtrayhide">
+    <method name="ListIcons">
+      <arg name="icons" type="aa{sv}" direction="out"/>
+    </method>
+    <method name="GetStatus">
+      <arg name="status" type="a{sv}" direction="out"/>
+    </method>
+    <method name="Capture">
+      <arg name="icon" type="s" direction="in"/>
+      <arg name="png" type="ay" direction="out"/>
+    </method>
+    <method name="Reload"/>
+    <method name="Recapture">
+      <arg name="icon" type="s" direction="in"/>
+    </method>
+    <method name="Click">
+      <arg name="icon" type="s" direction="in"/>
+      <arg name="button" type="y" direction="in"/>
+    </method>
+    <method name="ShowWindow">
+      <arg name="icon" type="s" direction="in"/>
+      <arg name="seconds" type="u" direction="in"/>
+    </method>
+    <signal name="IconDocked">
+      <arg name="id" type="s"/>
+      <arg name="window" type="u"/>
+    </signal>
+    <signal name="IconUndocked">
+      <arg name="id" type="s"/>
+      <arg name="window" type="u"/>
+    </signal>
+  </interface>
+  <interface name="org.freedesktop.DBus.Introspectable">
+    <method name="Introspect">
+      <arg name="xml" type="s" direction="out"/>
+    </method>
+  </interface>
+</node>
+`
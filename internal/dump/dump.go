@@ -0,0 +1,67 @@
+package dump
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bnema/xtrayhide/internal/sni"
+)
+
+// Dumper writes icon captures as PNG files for debugging.
+type Dumper struct {
+	dir string
+}
+
+func New(dir string) (*Dumper, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create dump dir: %w", err)
+	}
+	return &Dumper{dir: dir}, nil
+}
+
+// Write saves the capture as the X server returned it and the SNI pixmap
+// built from it, named after the window id, WM_CLASS and time.
+func (d *Dumper) Write(window uint32, class string, raw image.Image, pixmap sni.Pixmap) error {
+	stamp := time.Now().Format("20060102T150405.000")
+	base := fmt.Sprintf("0x%x-%s-%s", window, fileSafe(class), stamp)
+	if raw != nil {
+		if err := writePNG(filepath.Join(d.dir, base+"-raw.png"), raw); err != nil {
+			return err
+		}
+	}
+	if len(pixmap.Data) > 0 {
+		if err := writePNG(filepath.Join(d.dir, base+"-pixmap.png"), sni.ImageFromPixmap(pixmap)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writePNG(path string, img image.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", path, err)
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return fmt.Errorf("encode %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+func fileSafe(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == os.PathSeparator || r < ' ' {
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,195 @@
+// Package handoff passes the docked icons of a running daemon to a new
+// instance over a Unix socket, so an upgrade does not make clients re-dock.
+//
+// The new instance sends a request; the running one stops using its icons,
+// keeps their containers and SNI items alive and replies with its state. Once the new
+// instance owns the tray it sends done and the old one exits. If the
+// connection closes before that, the old instance resumes.
+package handoff
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Timeout bounds how long the running daemon waits for its successor to take
+// over before resuming.
+const Timeout = 30 * time.Second
+
+const (
+	msgRequest = "request"
+	msgState   = "state"
+	msgDone    = "done"
+	msgError   = "error"
+)
+
+type Icon struct {
+	Window    uint32 `json:"window"`
+	Container uint32 `json:"container"`
+	ID        string `json:"id,omitempty"`
+}
+
+type State struct {
+	Icons []Icon `json:"icons"`
+	// Trays are the manager windows of the tray processes owning the
+	// containers, kept until the successor no longer needs them.
+	Trays []uint32 `json:"trays"`
+}
+
+type message struct {
+	Type  string `json:"type"`
+	State *State `json:"state,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Handler is implemented by the running daemon.
+type Handler interface {
+	// Prepare stops using the icons and returns them for the successor.
+	Prepare() (State, error)
+	// Complete is called once the successor owns the tray.
+	Complete()
+	// Abort is called when the successor gave up after Prepare.
+	Abort()
+}
+
+// SocketPath returns the handoff socket for the current X display.
+func SocketPath() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	display := strings.NewReplacer("/", "_", ":", "").Replace(os.Getenv("DISPLAY"))
+	return filepath.Join(dir, "xtrayhide", "handoff-"+display+".sock")
+}
+
+type Listener struct {
+	ln   *net.UnixListener
+	path string
+	info os.FileInfo
+}
+
+// Listen serves handoff requests on path until Close. Any existing socket is
+// replaced: only the tray selection owner listens, and a predecessor still
+// shutting down removes only its own socket.
+func Listen(path string, h Handler) (*Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("create socket dir: %w", err)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("remove stale socket: %w", err)
+	}
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("listen %s: %w", path, err)
+	}
+	ln.SetUnlinkOnClose(false)
+	info, err := os.Stat(path)
+	if err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("stat %s: %w", path, err)
+	}
+	l := &Listener{ln: ln, path: path, info: info}
+	go l.serve(h)
+	return l, nil
+}
+
+func (l *Listener) Close() error {
+	err := l.ln.Close()
+	if info, statErr := os.Stat(l.path); statErr == nil && os.SameFile(info, l.info) {
+		os.Remove(l.path)
+	}
+	return err
+}
+
+func (l *Listener) serve(h Handler) {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			return
+		}
+		// One handoff at a time; a successful one ends the process.
+		serveConn(conn, h)
+	}
+}
+
+func serveConn(conn net.Conn, h Handler) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(Timeout))
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	enc := json.NewEncoder(conn)
+
+	var req message
+	if err := dec.Decode(&req); err != nil || req.Type != msgRequest {
+		return
+	}
+	state, err := h.Prepare()
+	if err != nil {
+		enc.Encode(message{Type: msgError, Error: err.Error()})
+		return
+	}
+	if err := enc.Encode(message{Type: msgState, State: &state}); err != nil {
+		h.Abort()
+		return
+	}
+	var reply message
+	if err := dec.Decode(&reply); err != nil || reply.Type != msgDone {
+		h.Abort()
+		return
+	}
+	h.Complete()
+}
+
+// Session is the successor's side of a handoff.
+type Session struct {
+	conn net.Conn
+}
+
+// Request asks the daemon listening on path for its icons. The session must
+// be completed once the caller owns the tray, or closed to let the running
+// daemon resume.
+func Request(path string) (*Session, State, error) {
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return nil, State{}, fmt.Errorf("connect %s: %w", path, err)
+	}
+	conn.SetDeadline(time.Now().Add(Timeout))
+	if err := json.NewEncoder(conn).Encode(message{Type: msgRequest}); err != nil {
+		conn.Close()
+		return nil, State{}, fmt.Errorf("send request: %w", err)
+	}
+	var reply message
+	if err := json.NewDecoder(conn).Decode(&reply); err != nil {
+		conn.Close()
+		return nil, State{}, fmt.Errorf("read state: %w", err)
+	}
+	switch {
+	case reply.Type == msgError:
+		conn.Close()
+		return nil, State{}, fmt.Errorf("running daemon refused: %s", reply.Error)
+	case reply.Type != msgState || reply.State == nil:
+		conn.Close()
+		return nil, State{}, fmt.Errorf("unexpected reply %q", reply.Type)
+	}
+	return &Session{conn: conn}, *reply.State, nil
+}
+
+// Complete tells the previous daemon to exit.
+func (s *Session) Complete() error {
+	defer s.conn.Close()
+	if err := json.NewEncoder(s.conn).Encode(message{Type: msgDone}); err != nil {
+		return fmt.Errorf("send done: %w", err)
+	}
+	return nil
+}
+
+// Close aborts the handoff.
+func (s *Session) Close() error {
+	return s.conn.Close()
+}
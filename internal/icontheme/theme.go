@@ -0,0 +1,454 @@
+// Package icontheme resolves icon names through the freedesktop icon theme
+// specification, so icons known only by name can be published as pixmaps.
+// SVG icons are skipped as there is no renderer for them; lookups fall back
+// to the closest PNG or XPM instead.
+package icontheme
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bnema/xtrayhide/internal/imaging"
+)
+
+const fallbackTheme = "hicolor"
+
+// DefaultSizes are the pixmap sizes rendered for SNI hosts.
+var DefaultSizes = []int{16, 22, 24, 32, 48}
+
+var extensions = []string{".png", ".xpm"}
+
+type directory struct {
+	path      string
+	size      int
+	scale     int
+	minSize   int
+	maxSize   int
+	threshold int
+	kind      string // Fixed, Scalable or Threshold
+}
+
+type theme struct {
+	parents []string
+	dirs    []directory
+	roots   []string // every base directory holding the theme
+}
+
+// Parsed themes and directory listings are cached until Reset.
+var cache = struct {
+	sync.Mutex
+	themes   map[string]*theme
+	listings map[string]map[string]bool
+}{}
+
+// Reset drops the cached themes and directory listings, so icons installed
+// since are found.
+func Reset() {
+	cache.Lock()
+	defer cache.Unlock()
+	cache.themes = nil
+	cache.listings = nil
+}
+
+// baseDirs returns the directories searched for themes, in precedence order.
+func baseDirs() []string {
+	var dirs []string
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs, filepath.Join(home, ".icons"))
+	}
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			dataHome = filepath.Join(home, ".local", "share")
+		}
+	}
+	if dataHome != "" {
+		dirs = append(dirs, filepath.Join(dataHome, "icons"))
+	}
+	dataDirs := os.Getenv("XDG_DATA_DIRS")
+	if dataDirs == "" {
+		dataDirs = "/usr/local/share:/usr/share"
+	}
+	for _, dir := range filepath.SplitList(dataDirs) {
+		if dir != "" {
+			dirs = append(dirs, filepath.Join(dir, "icons"))
+		}
+	}
+	return dirs
+}
+
+// Current returns the icon theme configured for GTK, or hicolor.
+func Current() string {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	home, _ := os.UserHomeDir()
+	if configHome == "" && home != "" {
+		configHome = filepath.Join(home, ".config")
+	}
+	for _, path := range []string{
+		filepath.Join(configHome, "gtk-4.0", "settings.ini"),
+		filepath.Join(configHome, "gtk-3.0", "settings.ini"),
+		filepath.Join(home, ".gtkrc-2.0"),
+	} {
+		if name := settingsTheme(path); name != "" {
+			return name
+		}
+	}
+	return fallbackTheme
+}
+
+func settingsTheme(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if ok && strings.TrimSpace(key) == "gtk-icon-theme-name" {
+			return strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return ""
+}
+
+// Lookup returns the file of the icon called name in themeName, or in the
+// themes it inherits from, that is closest to size pixels. extraDirs are
+// searched first, as base directories of their own.
+func Lookup(themeName, name string, size int, extraDirs ...string) (string, bool) {
+	cache.Lock()
+	defer cache.Unlock()
+	var chain []*theme
+	for _, base := range extraDirs {
+		for _, themeName := range []string{themeName, fallbackTheme} {
+			if t := extraTheme(base, themeName); t != nil {
+				chain = append(chain, t)
+			}
+		}
+	}
+	for _, t := range append(chain, themeChain(themeName)...) {
+		if path, ok := t.lookup(name, size, 1); ok {
+			return path, true
+		}
+	}
+	// Icons installed outside any theme.
+	dirs := append(append(extraDirs[:len(extraDirs):len(extraDirs)], baseDirs()...), "/usr/share/pixmaps")
+	for _, dir := range dirs {
+		for _, ext := range extensions {
+			if listing(dir)[name+ext] {
+				return filepath.Join(dir, name+ext), true
+			}
+		}
+	}
+	return "", false
+}
+
+// Render loads the icon called name at each of sizes. Sizes without a
+// matching file are scaled from the closest one; the result is empty when
+// the icon does not exist.
+func Render(themeName, name string, sizes []int, extraDirs ...string) []*image.NRGBA {
+	loaded := make(map[string]image.Image)
+	var images []*image.NRGBA
+	for _, size := range sizes {
+		path, ok := Lookup(themeName, name, size, extraDirs...)
+		if !ok {
+			continue
+		}
+		img, ok := loaded[path]
+		if !ok {
+			var err error
+			if img, err = load(path); err != nil {
+				continue
+			}
+			loaded[path] = img
+		}
+		images = append(images, imaging.Fit(img, size, size))
+	}
+	return images
+}
+
+// Resolve loads icon, either a path to an image file or the name of an icon
+// of the current theme rendered at DefaultSizes. For theme icons it returns
+// the name along with the images, and fails when the theme lacks it.
+func Resolve(icon string) (string, []image.Image, error) {
+	if !strings.Contains(icon, "/") {
+		var images []image.Image
+		for _, img := range Render(Current(), icon, DefaultSizes) {
+			images = append(images, img)
+		}
+		if len(images) == 0 {
+			return "", nil, fmt.Errorf("icon %s not found in theme %s", icon, Current())
+		}
+		return icon, images, nil
+	}
+	img, err := load(icon)
+	if err != nil {
+		return "", nil, fmt.Errorf("load icon: %w", err)
+	}
+	return "", []image.Image{img}, nil
+}
+
+func load(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", path, err)
+	}
+	return img, nil
+}
+
+// themeChain returns themeName followed by the themes it inherits from, depth
+// first, ending with hicolor. Missing themes are left out.
+func themeChain(themeName string) []*theme {
+	var chain []*theme
+	seen := make(map[string]bool)
+	var walk func(name string)
+	walk = func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		t := loadTheme(name)
+		if t == nil {
+			return
+		}
+		chain = append(chain, t)
+		for _, parent := range t.parents {
+			walk(parent)
+		}
+	}
+	walk(themeName)
+	walk(fallbackTheme)
+	return chain
+}
+
+func loadTheme(name string) *theme {
+	if t, ok := cache.themes[name]; ok {
+		return t
+	}
+	if cache.themes == nil {
+		cache.themes = make(map[string]*theme)
+	}
+	var t *theme
+	var roots []string
+	for _, base := range baseDirs() {
+		root := filepath.Join(base, name)
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			continue
+		}
+		roots = append(roots, root)
+		if t == nil {
+			t = parseIndex(filepath.Join(root, "index.theme"))
+		}
+	}
+	if t != nil {
+		t.roots = roots
+	}
+	cache.themes[name] = t
+	return t
+}
+
+// extraTheme returns the theme called name under an application's own base
+// directory. Such trees often lack an index.theme, in which case the layout
+// of the installed theme of that name is assumed. Extra themes are not cached.
+func extraTheme(base, name string) *theme {
+	root := filepath.Join(base, name)
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return nil
+	}
+	t := parseIndex(filepath.Join(root, "index.theme"))
+	if t == nil {
+		installed := loadTheme(name)
+		if installed == nil {
+			return nil
+		}
+		t = &theme{dirs: installed.dirs}
+	}
+	t.roots = []string{root}
+	return t
+}
+
+// parseIndex reads an index.theme file, returning nil if there is none.
+func parseIndex(path string) *theme {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	sections := make(map[string]map[string]string)
+	var current map[string]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			current = make(map[string]string)
+			sections[line[1:len(line)-1]] = current
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok && current != nil {
+			current[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	main, ok := sections["Icon Theme"]
+	if !ok {
+		return nil
+	}
+
+	t := &theme{parents: splitList(main["Inherits"])}
+	for _, name := range append(splitList(main["Directories"]), splitList(main["ScaledDirectories"])...) {
+		section, ok := sections[name]
+		if !ok {
+			continue
+		}
+		size, err := strconv.Atoi(section["Size"])
+		if err != nil {
+			continue
+		}
+		dir := directory{
+			path:      name,
+			size:      size,
+			scale:     intValue(section["Scale"], 1),
+			minSize:   intValue(section["MinSize"], size),
+			maxSize:   intValue(section["MaxSize"], size),
+			threshold: intValue(section["Threshold"], 2),
+			kind:      section["Type"],
+		}
+		if dir.kind == "" {
+			dir.kind = "Threshold"
+		}
+		t.dirs = append(t.dirs, dir)
+	}
+	return t
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func intValue(value string, fallback int) int {
+	if v, err := strconv.Atoi(value); err == nil {
+		return v
+	}
+	return fallback
+}
+
+// lookup implements LookupIcon from the specification: an exact size match
+// wins, otherwise the file in the directory closest in size.
+func (t *theme) lookup(name string, size, scale int) (string, bool) {
+	for _, dir := range t.dirs {
+		if !dir.matches(size, scale) {
+			continue
+		}
+		if path, ok := t.find(dir, name); ok {
+			return path, true
+		}
+	}
+	best, bestDistance := "", -1
+	for _, dir := range t.dirs {
+		distance := dir.distance(size, scale)
+		if bestDistance >= 0 && distance >= bestDistance {
+			continue
+		}
+		if path, ok := t.find(dir, name); ok {
+			best, bestDistance = path, distance
+		}
+	}
+	return best, bestDistance >= 0
+}
+
+func (t *theme) find(dir directory, name string) (string, bool) {
+	for _, root := range t.roots {
+		path := filepath.Join(root, dir.path)
+		for _, ext := range extensions {
+			if listing(path)[name+ext] {
+				return filepath.Join(path, name+ext), true
+			}
+		}
+	}
+	return "", false
+}
+
+func (d directory) matches(size, scale int) bool {
+	if d.scale != scale {
+		return false
+	}
+	switch d.kind {
+	case "Fixed":
+		return d.size == size
+	case "Scalable":
+		return d.minSize <= size && size <= d.maxSize
+	default:
+		return d.size-d.threshold <= size && size <= d.size+d.threshold
+	}
+}
+
+func (d directory) distance(size, scale int) int {
+	want := size * scale
+	switch d.kind {
+	case "Fixed":
+		return abs(d.size*d.scale - want)
+	case "Scalable":
+		if want < d.minSize*d.scale {
+			return d.minSize*d.scale - want
+		}
+		if want > d.maxSize*d.scale {
+			return want - d.maxSize*d.scale
+		}
+		return 0
+	default:
+		if want < (d.size-d.threshold)*d.scale {
+			return d.minSize*d.scale - want
+		}
+		if want > (d.size+d.threshold)*d.scale {
+			return want - d.maxSize*d.scale
+		}
+		return 0
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// listing returns the names of the files in dir, reading it on first use.
+func listing(dir string) map[string]bool {
+	if files, ok := cache.listings[dir]; ok {
+		return files
+	}
+	if cache.listings == nil {
+		cache.listings = make(map[string]map[string]bool)
+	}
+	files := make(map[string]bool)
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			files[entry.Name()] = true
+		}
+	}
+	cache.listings[dir] = files
+	return files
+}
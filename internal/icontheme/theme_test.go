@@ -0,0 +1,136 @@
+package icontheme
+
+import (
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testIndex = `[Icon Theme]
+Name=Test
+Inherits=hicolor
+Directories=16x16/apps,48x48/apps,scalable/apps
+
+[16x16/apps]
+Size=16
+Type=Fixed
+
+[48x48/apps]
+Size=48
+Type=Threshold
+
+[scalable/apps]
+Size=64
+MinSize=8
+MaxSize=512
+Type=Scalable
+`
+
+func TestDirectoryMatches(t *testing.T) {
+	fixed := directory{size: 16, scale: 1, minSize: 16, maxSize: 16, threshold: 2, kind: "Fixed"}
+	threshold := directory{size: 48, scale: 1, minSize: 48, maxSize: 48, threshold: 2, kind: "Threshold"}
+	scalable := directory{size: 64, scale: 1, minSize: 8, maxSize: 512, threshold: 2, kind: "Scalable"}
+	for _, tc := range []struct {
+		dir      directory
+		size     int
+		matches  bool
+		distance int
+	}{
+		{fixed, 16, true, 0},
+		{fixed, 22, false, 6},
+		{threshold, 46, true, 0},
+		{threshold, 51, false, 3},
+		{threshold, 32, false, 16},
+		{scalable, 8, true, 0},
+		{scalable, 4, false, 4},
+		{scalable, 600, false, 88},
+	} {
+		if got := tc.dir.matches(tc.size, 1); got != tc.matches {
+			t.Errorf("%s %d: matches(%d) = %v, want %v", tc.dir.kind, tc.dir.size, tc.size, got, tc.matches)
+		}
+		if got := tc.dir.distance(tc.size, 1); got != tc.distance {
+			t.Errorf("%s %d: distance(%d) = %d, want %d", tc.dir.kind, tc.dir.size, tc.size, got, tc.distance)
+		}
+	}
+	if fixed.matches(16, 2) {
+		t.Error("a scale 1 directory matched scale 2")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	data := t.TempDir()
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_DATA_HOME", filepath.Join(data, "none"))
+	t.Setenv("XDG_DATA_DIRS", data)
+	Reset()
+	t.Cleanup(Reset)
+
+	root := filepath.Join(data, "icons", "test")
+	writeFile(t, filepath.Join(root, "index.theme"), testIndex)
+	writePNG(t, filepath.Join(root, "16x16", "apps", "app.png"), 16)
+	writePNG(t, filepath.Join(root, "48x48", "apps", "app.png"), 48)
+	writePNG(t, filepath.Join(data, "icons", "hicolor", "22x22", "apps", "parent.png"), 22)
+	writeFile(t, filepath.Join(data, "icons", "hicolor", "index.theme"),
+		"[Icon Theme]\nDirectories=22x22/apps\n\n[22x22/apps]\nSize=22\nType=Fixed\n")
+	writePNG(t, filepath.Join(data, "icons", "loose.png"), 8)
+
+	for _, tc := range []struct {
+		name string
+		size int
+		want string
+	}{
+		{"app", 16, filepath.Join(root, "16x16", "apps", "app.png")},
+		{"app", 47, filepath.Join(root, "48x48", "apps", "app.png")},
+		{"app", 24, filepath.Join(root, "16x16", "apps", "app.png")},
+		{"app", 40, filepath.Join(root, "48x48", "apps", "app.png")},
+		{"parent", 22, filepath.Join(data, "icons", "hicolor", "22x22", "apps", "parent.png")},
+		{"loose", 22, filepath.Join(data, "icons", "loose.png")},
+	} {
+		got, ok := Lookup("test", tc.name, tc.size)
+		if !ok || got != tc.want {
+			t.Errorf("Lookup(%s, %d) = %q, %v; want %q", tc.name, tc.size, got, ok, tc.want)
+		}
+	}
+	if path, ok := Lookup("test", "missing", 16); ok {
+		t.Errorf("Lookup(missing) = %q", path)
+	}
+
+	// Extra directories come first and may lack an index.theme.
+	extra := t.TempDir()
+	writePNG(t, filepath.Join(extra, "hicolor", "22x22", "apps", "app.png"), 22)
+	if got, _ := Lookup("test", "app", 22, extra); got != filepath.Join(extra, "hicolor", "22x22", "apps", "app.png") {
+		t.Errorf("Lookup with extra dir = %q", got)
+	}
+
+	images := Render("test", "app", []int{16, 32})
+	if len(images) != 2 || images[0].Bounds().Dx() != 16 || images[1].Bounds().Dx() != 32 {
+		t.Errorf("Render returned %d images", len(images))
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writePNG(t *testing.T, path string, size int) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, image.NewNRGBA(image.Rect(0, 0, size, size))); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,229 @@
+package icontheme
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// XPM3 images are C sources declaring an array of strings: a header with the
+// size, the color table and one string per row. The decoder is registered
+// with the image package, so image.Decode reads them too.
+
+func init() {
+	image.RegisterFormat("xpm", "/* XPM */", DecodeXPM, DecodeXPMConfig)
+}
+
+// Named colors commonly found in icon XPMs; X11's rgb.txt has many more.
+var xpmColors = map[string]color.NRGBA{
+	"black":     {0, 0, 0, 0xff},
+	"white":     {0xff, 0xff, 0xff, 0xff},
+	"red":       {0xff, 0, 0, 0xff},
+	"green":     {0, 0xff, 0, 0xff},
+	"blue":      {0, 0, 0xff, 0xff},
+	"yellow":    {0xff, 0xff, 0, 0xff},
+	"cyan":      {0, 0xff, 0xff, 0xff},
+	"magenta":   {0xff, 0, 0xff, 0xff},
+	"gray":      {0xbe, 0xbe, 0xbe, 0xff},
+	"grey":      {0xbe, 0xbe, 0xbe, 0xff},
+	"lightgray": {0xd3, 0xd3, 0xd3, 0xff},
+	"lightgrey": {0xd3, 0xd3, 0xd3, 0xff},
+	"darkgray":  {0xa9, 0xa9, 0xa9, 0xff},
+	"darkgrey":  {0xa9, 0xa9, 0xa9, 0xff},
+	"orange":    {0xff, 0xa5, 0, 0xff},
+	"brown":     {0xa5, 0x2a, 0x2a, 0xff},
+}
+
+// Limits on the header values, well above what icons use, so a hostile file
+// cannot make the decoder allocate or index out of bounds.
+const (
+	maxXPMSize   = 1024
+	maxXPMColors = 1 << 16
+	maxXPMCpp    = 8
+)
+
+type xpmHeader struct {
+	width, height, colors, cpp int
+}
+
+func DecodeXPMConfig(r io.Reader) (image.Config, error) {
+	strs, err := xpmStrings(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	hdr, err := parseXPMHeader(strs)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: color.NRGBAModel, Width: hdr.width, Height: hdr.height}, nil
+}
+
+func DecodeXPM(r io.Reader) (image.Image, error) {
+	strs, err := xpmStrings(r)
+	if err != nil {
+		return nil, err
+	}
+	hdr, err := parseXPMHeader(strs)
+	if err != nil {
+		return nil, err
+	}
+	if len(strs) < 1+hdr.colors+hdr.height {
+		return nil, errors.New("xpm: truncated image")
+	}
+	rows := strs[1+hdr.colors : 1+hdr.colors+hdr.height]
+	for y, row := range rows {
+		if len(row) < hdr.width*hdr.cpp {
+			return nil, fmt.Errorf("xpm: row %d too short", y)
+		}
+	}
+
+	palette := make(map[string]color.NRGBA, hdr.colors)
+	for _, entry := range strs[1 : 1+hdr.colors] {
+		if len(entry) < hdr.cpp {
+			return nil, fmt.Errorf("xpm: bad color entry %q", entry)
+		}
+		c, err := parseXPMColor(entry[hdr.cpp:])
+		if err != nil {
+			return nil, err
+		}
+		palette[entry[:hdr.cpp]] = c
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, hdr.width, hdr.height))
+	for y, row := range rows {
+		for x := 0; x < hdr.width; x++ {
+			key := row[x*hdr.cpp : (x+1)*hdr.cpp]
+			c, ok := palette[key]
+			if !ok {
+				return nil, fmt.Errorf("xpm: undefined pixel %q", key)
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img, nil
+}
+
+// xpmStrings returns the string literals of an XPM source, skipping
+// comments.
+func xpmStrings(r io.Reader) ([]string, error) {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(src, []byte("/* XPM */")) {
+		return nil, errors.New("xpm: missing XPM signature")
+	}
+	var strs []string
+	for idx := 0; idx < len(src); idx++ {
+		switch {
+		case bytes.HasPrefix(src[idx:], []byte("/*")):
+			end := bytes.Index(src[idx+2:], []byte("*/"))
+			if end < 0 {
+				return nil, errors.New("xpm: unterminated comment")
+			}
+			idx += end + 3
+		case src[idx] == '"':
+			var sb strings.Builder
+			idx++
+			for ; idx < len(src) && src[idx] != '"'; idx++ {
+				if src[idx] == '\\' && idx+1 < len(src) {
+					idx++
+				}
+				sb.WriteByte(src[idx])
+			}
+			if idx >= len(src) {
+				return nil, errors.New("xpm: unterminated string")
+			}
+			strs = append(strs, sb.String())
+		}
+	}
+	return strs, nil
+}
+
+func parseXPMHeader(strs []string) (xpmHeader, error) {
+	if len(strs) == 0 {
+		return xpmHeader{}, errors.New("xpm: no header")
+	}
+	fields := strings.Fields(strs[0])
+	if len(fields) < 4 {
+		return xpmHeader{}, fmt.Errorf("xpm: bad header %q", strs[0])
+	}
+	var values [4]int
+	for idx := range values {
+		v, err := strconv.Atoi(fields[idx])
+		if err != nil || v <= 0 {
+			return xpmHeader{}, fmt.Errorf("xpm: bad header %q", strs[0])
+		}
+		values[idx] = v
+	}
+	hdr := xpmHeader{width: values[0], height: values[1], colors: values[2], cpp: values[3]}
+	if hdr.width > maxXPMSize || hdr.height > maxXPMSize || hdr.colors > maxXPMColors || hdr.cpp > maxXPMCpp {
+		return xpmHeader{}, fmt.Errorf("xpm: header %q out of range", strs[0])
+	}
+	return hdr, nil
+}
+
+// parseXPMColor reads the color of a color table entry, preferring the color
+// visual ("c") over the grayscale and monochrome ones.
+func parseXPMColor(spec string) (color.NRGBA, error) {
+	values := make(map[string]string)
+	var key string
+	for _, field := range strings.Fields(spec) {
+		switch field {
+		case "c", "g", "g4", "m", "s":
+			key = field
+			values[key] = ""
+		default:
+			if key == "" {
+				continue
+			}
+			// Named colors such as "light grey" span several fields.
+			values[key] = strings.TrimSpace(values[key] + " " + field)
+		}
+	}
+	for _, key := range []string{"c", "g", "g4", "m"} {
+		if value, ok := values[key]; ok && value != "" {
+			return xpmColor(value)
+		}
+	}
+	return color.NRGBA{}, fmt.Errorf("xpm: no color in %q", spec)
+}
+
+func xpmColor(value string) (color.NRGBA, error) {
+	if strings.EqualFold(value, "none") {
+		return color.NRGBA{}, nil
+	}
+	if hex, ok := strings.CutPrefix(value, "#"); ok {
+		n := len(hex) / 3
+		if n == 0 || len(hex)%3 != 0 || n > 4 {
+			return color.NRGBA{}, fmt.Errorf("xpm: bad color %q", value)
+		}
+		var rgb [3]uint8
+		for idx := range rgb {
+			v, err := strconv.ParseUint(hex[idx*n:(idx+1)*n], 16, 16)
+			if err != nil {
+				return color.NRGBA{}, fmt.Errorf("xpm: bad color %q", value)
+			}
+			// Keep the 8 most significant bits of each component.
+			switch n {
+			case 1:
+				v *= 0x11
+			case 3:
+				v >>= 4
+			case 4:
+				v >>= 8
+			}
+			rgb[idx] = uint8(v)
+		}
+		return color.NRGBA{R: rgb[0], G: rgb[1], B: rgb[2], A: 0xff}, nil
+	}
+	if c, ok := xpmColors[strings.ToLower(strings.ReplaceAll(value, " ", ""))]; ok {
+		return c, nil
+	}
+	return color.NRGBA{}, fmt.Errorf("xpm: unknown color %q", value)
+}
@@ -0,0 +1,58 @@
+package icontheme
+
+import (
+	"image/color"
+	"strings"
+	"testing"
+)
+
+const validXPM = `/* XPM */
+static char *icon[] = {
+/* columns rows colors chars-per-pixel */
+"3 2 3 1",
+"  c None",
+". c #ff0000",
+"X c light grey",
+" .X",
+"X. "
+};
+`
+
+func TestDecodeXPM(t *testing.T) {
+	img, err := DecodeXPM(strings.NewReader(validXPM))
+	if err != nil {
+		t.Fatalf("DecodeXPM: %v", err)
+	}
+	if got := img.Bounds().Size(); got.X != 3 || got.Y != 2 {
+		t.Fatalf("size = %v, want 3x2", got)
+	}
+	want := map[[2]int]color.NRGBA{
+		{0, 0}: {},
+		{1, 0}: {0xff, 0, 0, 0xff},
+		{2, 0}: {0xd3, 0xd3, 0xd3, 0xff},
+		{0, 1}: {0xd3, 0xd3, 0xd3, 0xff},
+	}
+	for at, c := range want {
+		if got := color.NRGBAModel.Convert(img.At(at[0], at[1])); got != c {
+			t.Errorf("pixel %v = %v, want %v", at, got, c)
+		}
+	}
+}
+
+func TestDecodeXPMRejects(t *testing.T) {
+	for name, src := range map[string]string{
+		"no signature":    `static char *icon[] = {"1 1 1 1", ". c #000", "."};`,
+		"truncated rows":  "/* XPM */\n\"2 2 1 1\",\n\". c #000\",\n\"..\"",
+		"short row":       "/* XPM */\n\"2 1 1 1\",\n\". c #000\",\n\".\"",
+		"undefined pixel": "/* XPM */\n\"1 1 1 1\",\n\". c #000\",\n\"x\"",
+		"zero width":      "/* XPM */\n\"0 1 1 1\",\n\". c #000\",\n\"\"",
+		"huge size":       "/* XPM */\n\"100000 100000 1 1\",\n\". c #000\"",
+		"huge colors":     "/* XPM */\n\"1 1 9223372036854775807 1\",\n\". c #000\",\n\".\"",
+		"huge cpp":        "/* XPM */\n\"1 1 1 4611686018427387904\",\n\". c #000\",\n\".\"",
+		"overflow":        "/* XPM */\n\"99999999999999999999 1 1 1\"",
+	} {
+		if _, err := DecodeXPM(strings.NewReader(src)); err == nil {
+			t.Errorf("%s: DecodeXPM succeeded", name)
+		}
+	}
+}
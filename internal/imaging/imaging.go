@@ -0,0 +1,125 @@
+// Package imaging holds the image scaling shared by captures, dock icons and
+// theme icons.
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// Fit scales src to fit a width x height canvas, keeping its aspect ratio and
+// centering it on a transparent background.
+func Fit(src image.Image, width, height int) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	sb := src.Bounds()
+	if sb.Empty() || width <= 0 || height <= 0 {
+		return dst
+	}
+	scale := min(float64(width)/float64(sb.Dx()), float64(height)/float64(sb.Dy()))
+	w := max(1, int(float64(sb.Dx())*scale+0.5))
+	h := max(1, int(float64(sb.Dy())*scale+0.5))
+	offX, offY := (width-w)/2, (height-h)/2
+	draw.Draw(dst, image.Rect(offX, offY, offX+w, offY+h), Resize(src, w, h), image.Point{}, draw.Src)
+	return dst
+}
+
+// Resize scales src to exactly width x height. Downscaling averages the
+// source pixels each destination pixel covers, weighted by how much of them
+// it covers, so thin lines of small icons survive; upscaling interpolates
+// linearly. Both work on premultiplied colors so transparent pixels do not
+// darken the edges.
+func Resize(src image.Image, width, height int) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	sb := src.Bounds()
+	if sb.Empty() || width <= 0 || height <= 0 {
+		return dst
+	}
+	sw, sh := sb.Dx(), sb.Dy()
+	pix := make([]float32, sw*sh*4)
+	for y := 0; y < sh; y++ {
+		for x := 0; x < sw; x++ {
+			r, g, b, a := src.At(sb.Min.X+x, sb.Min.Y+y).RGBA()
+			idx := (y*sw + x) * 4
+			pix[idx], pix[idx+1], pix[idx+2], pix[idx+3] = float32(r), float32(g), float32(b), float32(a)
+		}
+	}
+
+	// Scale the rows first, then the columns of the result.
+	xTaps, yTaps := kernel(sw, width), kernel(sh, height)
+	rows := make([]float32, width*sh*4)
+	for y := 0; y < sh; y++ {
+		for x, taps := range xTaps {
+			out := rows[(y*width+x)*4:]
+			for _, t := range taps {
+				in := pix[(y*sw+t.index)*4:]
+				for c := 0; c < 4; c++ {
+					out[c] += in[c] * t.weight
+				}
+			}
+		}
+	}
+	for y, taps := range yTaps {
+		for x := 0; x < width; x++ {
+			var px [4]float32
+			for _, t := range taps {
+				in := rows[(t.index*width+x)*4:]
+				for c := 0; c < 4; c++ {
+					px[c] += in[c] * t.weight
+				}
+			}
+			a := min(px[3], 0xffff)
+			if a < 0x80 {
+				continue
+			}
+			unpremul := func(v float32) uint8 { return uint8(min(v*0xff/a, 0xff) + 0.5) }
+			dst.SetNRGBA(x, y, color.NRGBA{R: unpremul(px[0]), G: unpremul(px[1]), B: unpremul(px[2]), A: uint8(a/0x101 + 0.5)})
+		}
+	}
+	return dst
+}
+
+type tap struct {
+	index  int
+	weight float32
+}
+
+// kernel returns, for every destination pixel along an axis, the source
+// pixels it is made of and their normalized weights.
+func kernel(srcLen, dstLen int) [][]tap {
+	scale := float64(srcLen) / float64(dstLen)
+	taps := make([][]tap, dstLen)
+	for d := range taps {
+		var row []tap
+		if scale >= 1 {
+			lo, hi := float64(d)*scale, float64(d+1)*scale
+			for s := int(lo); s < srcLen && float64(s) < hi; s++ {
+				if w := math.Min(hi, float64(s+1)) - math.Max(lo, float64(s)); w > 0 {
+					row = append(row, tap{index: s, weight: float32(w)})
+				}
+			}
+		} else {
+			center := (float64(d)+0.5)*scale - 0.5
+			s0 := int(math.Floor(center))
+			frac := center - float64(s0)
+			row = []tap{
+				{index: clamp(s0, srcLen), weight: float32(1 - frac)},
+				{index: clamp(s0+1, srcLen), weight: float32(frac)},
+			}
+		}
+		var sum float32
+		for _, t := range row {
+			sum += t.weight
+		}
+		for idx := range row {
+			row[idx].weight /= sum
+		}
+		taps[d] = row
+	}
+	return taps
+}
+
+func clamp(v, length int) int {
+	return max(0, min(v, length-1))
+}
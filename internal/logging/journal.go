@@ -0,0 +1,174 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// JournalHandler sends records to journald using its native protocol, so
+// attributes become journal fields (e.g. window=0x1a00003 is WINDOW).
+type JournalHandler struct {
+	conn       *net.UnixConn
+	identifier string
+	level      slog.Leveler
+	prefix     string
+	fields     []byte
+}
+
+func NewJournalHandler(identifier string, level slog.Leveler) (*JournalHandler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("connect journal: %w", err)
+	}
+	return &JournalHandler{conn: conn, identifier: identifier, level: level}, nil
+}
+
+func (h *JournalHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *JournalHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	writeField(&buf, "MESSAGE", r.Message)
+	writeField(&buf, "PRIORITY", strconv.Itoa(priority(r.Level)))
+	writeField(&buf, "SYSLOG_IDENTIFIER", h.identifier)
+	if r.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		writeField(&buf, "CODE_FILE", frame.File)
+		writeField(&buf, "CODE_LINE", strconv.Itoa(frame.Line))
+		writeField(&buf, "CODE_FUNC", frame.Function)
+	}
+	buf.Write(h.fields)
+	r.Attrs(func(a slog.Attr) bool {
+		writeAttr(&buf, h.prefix, a)
+		return true
+	})
+	return h.send(buf.Bytes())
+}
+
+func (h *JournalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var buf bytes.Buffer
+	buf.Write(h.fields)
+	for _, a := range attrs {
+		writeAttr(&buf, h.prefix, a)
+	}
+	clone := *h
+	clone.fields = buf.Bytes()
+	return &clone
+}
+
+func (h *JournalHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	clone := *h
+	clone.prefix = h.prefix + name + "_"
+	return &clone
+}
+
+// send writes one entry. Entries too large for a datagram are passed as a
+// sealed memfd instead, as sd_journal_send does.
+func (h *JournalHandler) send(entry []byte) error {
+	_, err := h.conn.Write(entry)
+	if err == nil || !(errors.Is(err, syscall.EMSGSIZE) || errors.Is(err, syscall.ENOBUFS)) {
+		return err
+	}
+	fd, err := unix.MemfdCreate("journal-entry", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return fmt.Errorf("memfd: %w", err)
+	}
+	f := os.NewFile(uintptr(fd), "journal-entry")
+	defer f.Close()
+	if _, err := f.Write(entry); err != nil {
+		return fmt.Errorf("write memfd: %w", err)
+	}
+	if _, err := unix.FcntlInt(uintptr(fd), unix.F_ADD_SEALS, unix.F_SEAL_SHRINK|unix.F_SEAL_GROW|unix.F_SEAL_WRITE|unix.F_SEAL_SEAL); err != nil {
+		return fmt.Errorf("seal memfd: %w", err)
+	}
+	_, _, err = h.conn.WriteMsgUnix(nil, unix.UnixRights(fd), nil)
+	return err
+}
+
+func writeAttr(buf *bytes.Buffer, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "_"
+		}
+		for _, sub := range a.Value.Group() {
+			writeAttr(buf, prefix, sub)
+		}
+		return
+	}
+	var value string
+	switch a.Value.Kind() {
+	case slog.KindTime:
+		value = a.Value.Time().Format(time.RFC3339Nano)
+	default:
+		value = a.Value.String()
+	}
+	writeField(buf, fieldName(prefix+a.Key), value)
+}
+
+// writeField appends KEY=value, or the length-prefixed form for values
+// containing newlines.
+func writeField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// fieldName maps an attribute key to a journal field name: upper case
+// letters, digits and underscores, starting with a letter.
+func fieldName(key string) string {
+	name := []byte(strings.ToUpper(key))
+	for idx, c := range name {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			name[idx] = '_'
+		}
+	}
+	if len(name) == 0 || name[0] < 'A' || name[0] > 'Z' {
+		return "X_" + string(name)
+	}
+	return string(name)
+}
+
+// priority maps slog levels to syslog priorities.
+func priority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	default:
+		return 7
+	}
+}
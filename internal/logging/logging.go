@@ -0,0 +1,74 @@
+// Package logging sets up the slog logger used by the daemon.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	FormatAuto    = ""
+	FormatText    = "text"
+	FormatJSON    = "json"
+	FormatJournal = "journal"
+)
+
+// New builds a logger writing to w at the given level ("debug", "info",
+// "warn" or "error"). FormatAuto logs to the journal when stderr is
+// connected to it, as under the systemd unit, and as text otherwise.
+func New(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("log level %q: %w", level, err)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	if format == FormatAuto {
+		format = FormatText
+		if StderrIsJournal() {
+			format = FormatJournal
+		}
+	}
+	switch strings.ToLower(format) {
+	case FormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case FormatJournal:
+		h, err := NewJournalHandler("xtrayhide", lvl)
+		if err != nil {
+			return nil, err
+		}
+		return slog.New(h), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// StderrIsJournal reports whether stderr is the stream systemd set up for
+// the journal, as described by $JOURNAL_STREAM.
+func StderrIsJournal() bool {
+	stream := os.Getenv("JOURNAL_STREAM")
+	if stream == "" {
+		return false
+	}
+	var dev, ino uint64
+	if _, err := fmt.Sscanf(stream, "%d:%d", &dev, &ino); err != nil {
+		return false
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(int(os.Stderr.Fd()), &st); err != nil {
+		return false
+	}
+	return uint64(st.Dev) == dev && uint64(st.Ino) == ino
+}
+
+// Window formats an X window id the way xprop and xwininfo print it.
+func Window(id uint32) slog.Attr {
+	return slog.String("window", fmt.Sprintf("0x%x", id))
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"image"
+	"image/color"
+)
+
+// Color blended into the icon to build its attention variant.
+var attentionTint = color.NRGBA{R: 0xe0, G: 0x40, B: 0x30, A: 0xff}
+
+const attentionTintAmount = 0.45
+
+// onUrgency runs on the tray event loop when the client sets or clears the
+// WM_HINTS urgency hint.
+func (p *Proxy) onUrgency(urgent bool) {
+	p.captureMu.Lock()
+	p.attention = urgent
+	img := p.lastImage
+	p.captureMu.Unlock()
+	defer p.changed()
+
+	item := p.sniItem()
+	if item == nil {
+		return
+	}
+	if !urgent {
+		item.UpdateStatus("Active")
+		return
+	}
+	if img != nil {
+		item.UpdateAttentionIcon(Pixmaps(tintAttention(img), p.options().Sizes))
+	} else {
+		// Captures wait for the icon to draw, which the event loop reports.
+		select {
+		case p.attend <- struct{}{}:
+		default:
+		}
+	}
+	item.UpdateStatus("NeedsAttention")
+}
+
+// captureAttention runs on the poll goroutine to publish the attention icon
+// of an icon that was not captured yet.
+func (p *Proxy) captureAttention() {
+	img, err := p.icon.CaptureImage()
+	if err != nil {
+		p.log.Debug("capture failed", "err", err)
+		return
+	}
+	p.captureMu.Lock()
+	urgent := p.attention
+	p.captureMu.Unlock()
+	if item := p.sniItem(); urgent && item != nil {
+		item.UpdateAttentionIcon(Pixmaps(tintAttention(img), p.options().Sizes))
+	}
+}
+
+// tintAttention returns a copy of img blended towards the attention color,
+// keeping its alpha channel.
+func tintAttention(img *image.NRGBA) *image.NRGBA {
+	tinted := image.NewNRGBA(img.Bounds())
+	blend := func(c, t uint8) uint8 {
+		return uint8(float64(c)*(1-attentionTintAmount) + float64(t)*attentionTintAmount)
+	}
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			c := img.NRGBAAt(x, y)
+			tinted.SetNRGBA(x, y, color.NRGBA{
+				R: blend(c.R, attentionTint.R),
+				G: blend(c.G, attentionTint.G),
+				B: blend(c.B, attentionTint.B),
+				A: c.A,
+			})
+		}
+	}
+	return tinted
+}
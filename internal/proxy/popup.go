@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"time"
+
+	"github.com/bnema/xtrayhide/internal/sni"
+	"github.com/bnema/xtrayhide/internal/tray"
+)
+
+const (
+	// How long to wait for the client to open its popup after a right click.
+	popupTimeout = 700 * time.Millisecond
+	// Time given to the client to paint the popup before capturing it.
+	popupSettle = 150 * time.Millisecond
+	// Delay before dismissing the hidden popup once the host menu closed,
+	// as some hosts report "closed" before "clicked".
+	popupCloseDelay = 500 * time.Millisecond
+	// Hidden popups hold pointer grabs; never keep one open longer than this.
+	popupMaxLifetime = 30 * time.Second
+
+	menuScrapedBase int32 = 100
+
+	minMenuRowHeight = 6
+	maxMenuRowGap    = 2
+)
+
+type scrapedEntry struct {
+	x, y int16
+}
+
+// MenuAboutToShow opens the application's own popup menu in the background and
+// mirrors its rows into the DBusMenu. The host gets the current entries right
+// away and a layout update once the rows were scraped.
+func (p *Proxy) MenuAboutToShow() bool {
+	p.popupMu.Lock()
+	p.menuOpen = true
+	busy := p.scraping
+	p.scraping = true
+	p.popupMu.Unlock()
+	if !busy {
+		go p.mirrorAppMenu()
+	}
+	return false
+}
+
+func (p *Proxy) MenuClosed() {
+	p.popupMu.Lock()
+	p.menuOpen = false
+	popup := p.popup
+	p.popupMu.Unlock()
+	if popup != nil {
+		time.AfterFunc(popupCloseDelay, func() { p.dismissPopupIf(popup) })
+	}
+}
+
+// mirrorAppMenu scrapes the application's popup and puts its rows in front of
+// the bridge entries, or drops the rows of a previous popup.
+func (p *Proxy) mirrorAppMenu() {
+	items, err := p.scrapeAppMenu()
+	if err != nil {
+		p.log.Warn("scrape app menu failed", "err", err)
+	}
+	p.popupMu.Lock()
+	p.scraping = false
+	// Rows arriving after the host menu closed are of no use.
+	if !p.menuOpen {
+		items = nil
+	}
+	changed := p.scraped || len(items) > 0
+	p.scraped = len(items) > 0
+	p.popupMu.Unlock()
+
+	item := p.sniItem()
+	if len(items) == 0 {
+		p.dismissPopup()
+		if changed && item != nil {
+			item.Menu().SetItems(defaultMenu())
+		}
+		return
+	}
+	if item == nil {
+		return
+	}
+	items = append(items, sni.MenuItem{ID: menuScrapedBase - 1, Separator: true})
+	item.Menu().SetItems(append(items, defaultMenu()...))
+}
+
+func (p *Proxy) clickScraped(id int32) {
+	p.popupMu.Lock()
+	popup := p.popup
+	entry, ok := p.entries[id]
+	p.popup = nil
+	p.entries = nil
+	p.popupMu.Unlock()
+	if popup == nil || !ok {
+		return
+	}
+	popup.Click(entry.x, entry.y)
+}
+
+func (p *Proxy) scrapeAppMenu() ([]sni.MenuItem, error) {
+	p.dismissPopup()
+
+	ch := make(chan *tray.Popup, 1)
+	p.popupMu.Lock()
+	p.popupCh = ch
+	p.popupMu.Unlock()
+
+	p.click(p.options().ContextButton, 0, 0)
+
+	var popup *tray.Popup
+	select {
+	case popup = <-ch:
+	case <-time.After(popupTimeout):
+	case <-p.done:
+	}
+	p.popupMu.Lock()
+	p.popupCh = nil
+	p.popupMu.Unlock()
+	if popup == nil {
+		p.log.Debug("client opened no popup")
+		return nil, nil
+	}
+
+	time.Sleep(popupSettle)
+	img, err := popup.Capture()
+	if err != nil {
+		popup.Dismiss()
+		return nil, fmt.Errorf("capture popup: %w", err)
+	}
+
+	var items []sni.MenuItem
+	entries := make(map[int32]scrapedEntry)
+	for idx, row := range menuRows(img) {
+		id := menuScrapedBase + int32(idx)
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img.SubImage(row)); err != nil {
+			continue
+		}
+		// The row image is all there is to the entry, so it has no label.
+		items = append(items, sni.MenuItem{
+			ID:       id,
+			Enabled:  true,
+			IconData: buf.Bytes(),
+		})
+		center := row.Min.Add(row.Max).Div(2)
+		entries[id] = scrapedEntry{x: int16(center.X), y: int16(center.Y)}
+	}
+	p.log.Debug("scraped app menu", "entries", len(items))
+	if len(items) == 0 {
+		popup.Dismiss()
+		return nil, nil
+	}
+
+	p.popupMu.Lock()
+	p.popup = popup
+	p.entries = entries
+	p.popupMu.Unlock()
+	time.AfterFunc(popupMaxLifetime, func() { p.dismissPopupIf(popup) })
+	return items, nil
+}
+
+// onPopup runs on the tray event loop when the icon's client maps a popup.
+func (p *Proxy) onPopup(popup *tray.Popup) {
+	p.popupMu.Lock()
+	ch := p.popupCh
+	p.popupMu.Unlock()
+	if ch == nil {
+		return
+	}
+	if err := popup.Hide(); err != nil {
+		p.log.Warn("hide popup failed", "err", err)
+		return
+	}
+	select {
+	case ch <- popup:
+	default:
+	}
+}
+
+func (p *Proxy) dismissPopup() {
+	p.dismissPopupIf(nil)
+}
+
+// dismissPopupIf closes the hidden popup if it is still match (or any popup
+// when match is nil).
+func (p *Proxy) dismissPopupIf(match *tray.Popup) {
+	p.popupMu.Lock()
+	popup := p.popup
+	if popup == nil || (match != nil && popup != match) {
+		p.popupMu.Unlock()
+		return
+	}
+	p.popup = nil
+	p.entries = nil
+	p.popupMu.Unlock()
+	popup.Dismiss()
+}
+
+// menuRows splits a captured popup menu into its entries. Entries are runs of
+// rows with visible content, separated by rows of a single color (padding,
+// separator lines).
+func menuRows(img *image.NRGBA) []image.Rectangle {
+	b := img.Bounds()
+	inset := min(4, b.Dx()/4)
+	uniform := func(y int) bool {
+		first := img.NRGBAAt(b.Min.X+inset, y)
+		for x := b.Min.X + inset; x < b.Max.X-inset; x++ {
+			if img.NRGBAAt(x, y) != first {
+				return false
+			}
+		}
+		return true
+	}
+
+	var bands []image.Rectangle
+	start := -1
+	for y := b.Min.Y; y <= b.Max.Y; y++ {
+		if y < b.Max.Y && !uniform(y) {
+			if start < 0 {
+				start = y
+			}
+			continue
+		}
+		if start < 0 {
+			continue
+		}
+		band := image.Rect(b.Min.X, start, b.Max.X, y)
+		if n := len(bands); n > 0 && band.Min.Y-bands[n-1].Max.Y <= maxMenuRowGap {
+			bands[n-1].Max.Y = band.Max.Y
+		} else {
+			bands = append(bands, band)
+		}
+		start = -1
+	}
+
+	var rows []image.Rectangle
+	for _, band := range bands {
+		if band.Dy() >= minMenuRowHeight {
+			rows = append(rows, band)
+		}
+	}
+	// Extend each row halfway into the surrounding gaps so it covers the
+	// whole clickable entry.
+	grown := make([]image.Rectangle, len(rows))
+	for idx, row := range rows {
+		grown[idx] = row
+		if idx > 0 {
+			grown[idx].Min.Y -= (row.Min.Y - rows[idx-1].Max.Y) / 2
+		}
+		if idx < len(rows)-1 {
+			grown[idx].Max.Y += (rows[idx+1].Min.Y - row.Max.Y) / 2
+		}
+	}
+	return grown
+}
@@ -2,11 +2,16 @@ package proxy
 
 import (
 	"hash/fnv"
+	"image"
+	"log/slog"
+	"sync"
 	"time"
 
 	"github.com/jezek/xgb"
 	"github.com/jezek/xgb/xproto"
 
+	"github.com/bnema/xtrayhide/internal/dump"
+	"github.com/bnema/xtrayhide/internal/imaging"
 	"github.com/bnema/xtrayhide/internal/sni"
 	"github.com/bnema/xtrayhide/internal/tray"
 )
@@ -15,42 +20,249 @@ const (
 	pollInterval = 300 * time.Millisecond
 )
 
+const (
+	menuLeftClick int32 = iota + 1
+	menuMiddleClick
+	menuAppMenu
+	menuRaise
+	menuRecapture
+	menuSeparator
+	menuKill
+)
+
+type CaptureMode int
+
+const (
+	// CapturePoll captures the icon periodically and publishes changes.
+	CapturePoll CaptureMode = iota
+	// CaptureOnce keeps the icon captured at dock time.
+	CaptureOnce
+	// CaptureOff never publishes captures, for icons overridden by the user.
+	CaptureOff
+)
+
+type InputMethod int
+
+const (
+	// InputSendEvent delivers synthetic button events with SendEvent.
+	InputSendEvent InputMethod = iota
+	// InputXTest delivers real button events through the XTEST extension.
+	InputXTest
+)
+
+type ActivateMode int
+
+const (
+	// ActivateClick sends the activate button to the icon.
+	ActivateClick ActivateMode = iota
+	// ActivateRaise raises the application's main window instead.
+	ActivateRaise
+	// ActivateToggle iconifies the main window when it is active and raises
+	// it otherwise.
+	ActivateToggle
+)
+
+type Options struct {
+	Capture  CaptureMode
+	Input    InputMethod
+	Activate ActivateMode
+	// Buttons sent for Activate, SecondaryActivate and ContextMenu.
+	ActivateButton  uint8
+	SecondaryButton uint8
+	ContextButton   uint8
+	// FixedTitle keeps the item title when the client renames its window.
+	FixedTitle bool
+	// Sizes of the published pixmaps; captures are scaled to each of them.
+	// When empty a single pixmap at the captured size is published.
+	Sizes []int
+	// Dump, when set, receives every published capture.
+	Dump *dump.Dumper
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Capture:         CapturePoll,
+		Input:           InputSendEvent,
+		ActivateButton:  1,
+		SecondaryButton: 2,
+		ContextButton:   3,
+	}
+}
+
 type Proxy struct {
 	conn *xgb.Conn
 	root xproto.Window
 	icon *tray.Icon
-	item *sni.Item
+	log  *slog.Logger
 	done chan struct{}
+	// polled is closed once pollIcon stopped touching the icon.
+	polled chan struct{}
+	// redraw asks pollIcon for a capture before the next tick, attend for
+	// one of the attention icon.
+	redraw chan struct{}
+	attend chan struct{}
+
+	optsMu sync.RWMutex
+	opts   Options
+
+	itemMu   sync.Mutex
+	item     *sni.Item
+	onChange func()
+
+	captureMu   sync.Mutex
+	lastHash    uint32
+	lastImage   *image.NRGBA
+	lastCapture time.Time
+	attention   bool
+
+	popupMu sync.Mutex
+	popupCh chan *tray.Popup
+	popup   *tray.Popup
+	entries map[int32]scrapedEntry
+	scraped bool
+	// menuOpen is set while the host shows the menu, scraping while the
+	// application's popup is being scraped for it.
+	menuOpen bool
+	scraping bool
 }
 
-func New(conn *xgb.Conn, root xproto.Window, icon *tray.Icon, item *sni.Item) *Proxy {
+// New starts capturing icon. Captures are published to the SNI item set with
+// SetItem, if any, and reported to the change handler.
+func New(conn *xgb.Conn, root xproto.Window, icon *tray.Icon, opts Options) *Proxy {
 	p := &Proxy{
-		conn: conn,
-		root: root,
-		icon: icon,
-		item: item,
-		done: make(chan struct{}),
+		conn:   conn,
+		root:   root,
+		icon:   icon,
+		opts:   opts,
+		done:   make(chan struct{}),
+		polled: make(chan struct{}),
+		redraw: make(chan struct{}, 1),
+		attend: make(chan struct{}, 1),
+	}
+	_, class := icon.WMClass()
+	p.log = icon.Logger().With("class", class)
+	icon.SetPopupHandler(p.onPopup)
+	icon.SetTitleHandler(p.onTitle)
+	icon.SetUrgencyHandler(p.onUrgency)
+	icon.SetContentHandler(p.onContent)
+	if icon.Urgent() {
+		p.onUrgency(true)
 	}
-	item.SetHandler(p)
 	go p.pollIcon()
 	return p
 }
 
+// Close stops the proxy. Once it returns the proxy no longer uses the icon
+// window or its item, which the caller closes.
 func (p *Proxy) Close() {
 	close(p.done)
-	p.item.Close()
+	<-p.polled
+	p.icon.SetPopupHandler(nil)
+	p.icon.SetTitleHandler(nil)
+	p.icon.SetUrgencyHandler(nil)
+	p.icon.SetContentHandler(nil)
+	p.dismissPopup()
+	p.SetItem(nil)
+}
+
+// SetItem makes the proxy publish to item and handle its actions, bringing
+// it up to date with the last capture. A nil item detaches the current one.
+func (p *Proxy) SetItem(item *sni.Item) {
+	p.itemMu.Lock()
+	previous := p.item
+	p.item = item
+	p.itemMu.Unlock()
+	if previous != nil && previous != item {
+		previous.SetHandler(nil)
+		previous.Menu().SetHandler(nil)
+	}
+	if item == nil {
+		return
+	}
+	item.SetHandler(p)
+	item.Menu().SetHandler(p)
+	item.Menu().SetItems(defaultMenu())
+
+	p.captureMu.Lock()
+	img, attention := p.lastImage, p.attention
+	p.captureMu.Unlock()
+	sizes := p.options().Sizes
+	if img != nil && p.options().Capture != CaptureOff {
+		item.UpdateIcon(Pixmaps(img, sizes))
+	}
+	if attention {
+		if img != nil {
+			item.UpdateAttentionIcon(Pixmaps(tintAttention(img), sizes))
+		}
+		item.UpdateStatus("NeedsAttention")
+	}
+}
+
+func (p *Proxy) sniItem() *sni.Item {
+	p.itemMu.Lock()
+	defer p.itemMu.Unlock()
+	return p.item
+}
+
+// SetChangeHandler registers fn to be called when the published capture,
+// title or attention state changes. fn is called from the tray event loop
+// and capture goroutines and must not block.
+func (p *Proxy) SetChangeHandler(fn func()) {
+	p.itemMu.Lock()
+	p.onChange = fn
+	p.itemMu.Unlock()
+}
+
+func (p *Proxy) changed() {
+	p.itemMu.Lock()
+	fn := p.onChange
+	p.itemMu.Unlock()
+	if fn != nil {
+		fn()
+	}
+}
+
+// SetOptions changes the capture and input behavior of a running proxy.
+func (p *Proxy) SetOptions(opts Options) {
+	p.optsMu.Lock()
+	p.opts = opts
+	p.optsMu.Unlock()
+}
+
+func (p *Proxy) options() Options {
+	p.optsMu.RLock()
+	defer p.optsMu.RUnlock()
+	return p.opts
 }
 
 func (p *Proxy) Activate(x, y int32) {
-	p.sendClick(uint8(1), x, y)
+	opts := p.options()
+	var err error
+	switch opts.Activate {
+	case ActivateClick:
+		p.click(opts.ActivateButton, x, y)
+		return
+	case ActivateRaise:
+		err = p.icon.RaiseMainWindow()
+	case ActivateToggle:
+		var shown bool
+		if shown, err = p.icon.ToggleMainWindow(); err == nil {
+			p.log.Debug("toggled main window", "shown", shown)
+		}
+	}
+	// Without a window to show, the click may still do something.
+	if err != nil {
+		p.log.Debug("activate main window failed, clicking instead", "err", err)
+		p.click(opts.ActivateButton, x, y)
+	}
 }
 
 func (p *Proxy) SecondaryActivate(x, y int32) {
-	p.sendClick(uint8(2), x, y)
+	p.click(p.options().SecondaryButton, x, y)
 }
 
 func (p *Proxy) ContextMenu(x, y int32) {
-	p.sendClick(uint8(3), x, y)
+	p.click(p.options().ContextButton, x, y)
 }
 
 func (p *Proxy) Scroll(delta int32, orientation string) {
@@ -66,7 +278,80 @@ func (p *Proxy) Scroll(delta int32, orientation string) {
 			button = 5
 		}
 	}
-	p.sendClick(button, 0, 0)
+	p.click(button, 0, 0)
+}
+
+func (p *Proxy) MenuClicked(id int32) {
+	if id >= menuScrapedBase {
+		p.clickScraped(id)
+		return
+	}
+	switch id {
+	case menuLeftClick:
+		p.click(uint8(1), 0, 0)
+	case menuMiddleClick:
+		p.click(uint8(2), 0, 0)
+	case menuAppMenu:
+		p.click(uint8(3), 0, 0)
+	case menuRaise:
+		if err := p.icon.RaiseMainWindow(); err != nil {
+			p.log.Warn("raise main window failed", "err", err)
+		}
+	case menuRecapture:
+		p.Recapture()
+	case menuKill:
+		p.icon.KillClient()
+	}
+}
+
+func defaultMenu() []sni.MenuItem {
+	return []sni.MenuItem{
+		{ID: menuLeftClick, Label: "Left click", Enabled: true},
+		{ID: menuMiddleClick, Label: "Middle click", Enabled: true},
+		{ID: menuAppMenu, Label: "Open app menu", Enabled: true},
+		{ID: menuRaise, Label: "Raise main window", Enabled: true},
+		{ID: menuRecapture, Label: "Re-capture icon", Enabled: true},
+		{ID: menuSeparator, Separator: true},
+		{ID: menuKill, Label: "Kill application", Enabled: true},
+	}
+}
+
+// onTitle runs on the tray event loop when the client renames its icon
+// window, which many apps use to show unread counts.
+func (p *Proxy) onTitle(title string) {
+	if title == "" {
+		return
+	}
+	defer p.changed()
+	item := p.sniItem()
+	if item == nil {
+		return
+	}
+	if !p.options().FixedTitle {
+		item.UpdateTitle(title)
+	}
+	tooltip := item.ToolTip()
+	if tooltip.Title == "" {
+		tooltip.Title = title
+	}
+	if tooltip.Title == title {
+		tooltip.Description = ""
+	} else {
+		tooltip.Description = title
+	}
+	item.UpdateToolTip(tooltip)
+}
+
+// click delivers button to the icon with the configured input method.
+func (p *Proxy) click(button uint8, x, y int32) {
+	if p.options().Input == InputXTest {
+		err := p.icon.FakeClick(button)
+		if err == nil {
+			return
+		}
+		p.log.Warn("xtest click failed, falling back to SendEvent", "button", button, "err", err)
+	}
+	p.sendClick(button, x, y)
 }
 
 func (p *Proxy) sendClick(button uint8, x, y int32) {
@@ -101,7 +386,7 @@ func (p *Proxy) sendClick(button uint8, x, y int32) {
 }
 
 func (p *Proxy) pollIcon() {
-	var lastHash uint32
+	defer close(p.polled)
 	ticker := time.NewTicker(pollInterval)
 	defer ticker.Stop()
 	for {
@@ -109,19 +394,127 @@ func (p *Proxy) pollIcon() {
 		case <-p.done:
 			return
 		case <-ticker.C:
-			width, height, data, err := p.icon.Capture()
-			if err != nil || len(data) == 0 {
-				continue
-			}
-			h := hashBytes(data)
-			if h == lastHash {
-				continue
-			}
-			lastHash = h
-			pixmap := sni.Pixmap{Width: int32(width), Height: int32(height), Data: data}
-			p.item.UpdateIcon([]sni.Pixmap{pixmap})
+		case <-p.redraw:
+		case <-p.attend:
+			p.captureAttention()
+			continue
+		}
+		if p.options().Capture == CapturePoll {
+			p.refreshIcon(false)
+		}
+	}
+}
+
+// onContent runs on the tray event loop when the shown icon draws.
+func (p *Proxy) onContent() {
+	select {
+	case p.redraw <- struct{}{}:
+	default:
+	}
+}
+
+// Image returns the last published capture, or nil.
+func (p *Proxy) Image() *image.NRGBA {
+	p.captureMu.Lock()
+	defer p.captureMu.Unlock()
+	return p.lastImage
+}
+
+// NeedsAttention reports whether the client set the urgency hint.
+func (p *Proxy) NeedsAttention() bool {
+	p.captureMu.Lock()
+	defer p.captureMu.Unlock()
+	return p.attention
+}
+
+// LastCapture returns when a capture was last published, or the zero time.
+func (p *Proxy) LastCapture() time.Time {
+	p.captureMu.Lock()
+	defer p.captureMu.Unlock()
+	return p.lastCapture
+}
+
+// Click sends button to the icon with the configured input method.
+func (p *Proxy) Click(button uint8) {
+	p.click(button, 0, 0)
+}
+
+// Recapture captures and publishes the icon even if it did not change.
+func (p *Proxy) Recapture() {
+	p.refreshIcon(true)
+}
+
+// refreshIcon captures the icon and publishes it when it changed, or
+// unconditionally when force is set.
+func (p *Proxy) refreshIcon(force bool) {
+	if p.options().Capture == CaptureOff {
+		return
+	}
+	if p.publish(force) {
+		p.changed()
+	}
+}
+
+// publish does the capture of refreshIcon, reporting whether it published.
+func (p *Proxy) publish(force bool) bool {
+	p.captureMu.Lock()
+	defer p.captureMu.Unlock()
+
+	// The undecoded capture is only kept for dumps.
+	dumper := p.options().Dump
+	var raw, img *image.NRGBA
+	var err error
+	if dumper != nil {
+		raw, img, err = p.icon.CaptureRaw()
+	} else {
+		img, err = p.icon.CaptureImage()
+	}
+	if err != nil {
+		p.log.Debug("capture failed", "err", err)
+		return false
+	}
+	h := hashBytes(img.Pix)
+	if h == p.lastHash && !force {
+		return false
+	}
+	p.lastHash = h
+	p.lastImage = img
+	p.lastCapture = time.Now()
+	opts := p.options()
+	pixmaps := Pixmaps(img, opts.Sizes)
+	item := p.sniItem()
+	if item != nil {
+		item.UpdateIcon(pixmaps)
+	}
+	p.log.Debug("icon changed", "width", img.Rect.Dx(), "height", img.Rect.Dy(), "forced", force)
+	if dumper != nil {
+		_, class := p.icon.WMClass()
+		if err := dumper.Write(uint32(p.icon.Window), class, raw, pixmaps[len(pixmaps)-1]); err != nil {
+			p.log.Warn("dump capture failed", "err", err)
+		}
+	}
+	if p.attention && item != nil {
+		item.UpdateAttentionIcon(Pixmaps(tintAttention(img), opts.Sizes))
+	}
+	return true
+}
+
+// Pixmaps converts a capture into one pixmap per size, in the order of
+// sizes. Sizes are heights: wide icons keep their aspect ratio.
+func Pixmaps(img *image.NRGBA, sizes []int) []sni.Pixmap {
+	if len(sizes) == 0 || img.Rect.Empty() {
+		return []sni.Pixmap{sni.PixmapFromImage(img)}
+	}
+	pixmaps := make([]sni.Pixmap, 0, len(sizes))
+	for _, size := range sizes {
+		scaled := img
+		if img.Rect.Dy() != size {
+			width := max(1, (img.Rect.Dx()*size+img.Rect.Dy()/2)/img.Rect.Dy())
+			scaled = imaging.Resize(img, width, size)
 		}
+		pixmaps = append(pixmaps, sni.PixmapFromImage(scaled))
 	}
+	return pixmaps
 }
 
 func hashBytes(data []byte) uint32 {
@@ -0,0 +1,246 @@
+package sni
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	watcherName      = "org.kde.StatusNotifierWatcher"
+	watcherPath      = dbus.ObjectPath("/StatusNotifierWatcher")
+	watcherInterface = "org.kde.StatusNotifierWatcher"
+	itemInterface    = "org.kde.StatusNotifierItem"
+	defaultItemPath  = dbus.ObjectPath("/StatusNotifierItem")
+)
+
+type HostEventKind int
+
+const (
+	ItemAdded HostEventKind = iota
+	ItemRemoved
+	// ItemChanged is sent when an item emits one of its New* signals.
+	ItemChanged
+)
+
+// HostEvent reports a change to a registered item, identified by its watcher
+// address (bus name followed by the object path).
+type HostEvent struct {
+	Kind HostEventKind
+	Item string
+}
+
+// Host is a StatusNotifierHost: it follows the items registered with the
+// watcher and their change signals.
+type Host struct {
+	conn    *dbus.Conn
+	name    string
+	signals chan *dbus.Signal
+	events  chan HostEvent
+
+	mu     sync.Mutex
+	owners map[string][]string // unique bus name -> item addresses
+}
+
+func NewHost(conn *dbus.Conn) (*Host, error) {
+	name := fmt.Sprintf("org.kde.StatusNotifierHost-%d", os.Getpid())
+	reply, err := conn.RequestName(name, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		return nil, fmt.Errorf("request name: %w", err)
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		return nil, fmt.Errorf("dbus name not available: %s", name)
+	}
+
+	h := &Host{
+		conn:    conn,
+		name:    name,
+		signals: make(chan *dbus.Signal, 64),
+		events:  make(chan HostEvent, 64),
+		owners:  make(map[string][]string),
+	}
+	if err := conn.AddMatchSignal(dbus.WithMatchInterface(watcherInterface)); err != nil {
+		return nil, fmt.Errorf("match watcher signals: %w", err)
+	}
+	if err := conn.AddMatchSignal(dbus.WithMatchInterface(itemInterface)); err != nil {
+		return nil, fmt.Errorf("match item signals: %w", err)
+	}
+	conn.Signal(h.signals)
+
+	watcher := conn.Object(watcherName, watcherPath)
+	if call := watcher.Call(watcherInterface+".RegisterStatusNotifierHost", 0, name); call.Err != nil {
+		return nil, fmt.Errorf("register host: %w", call.Err)
+	}
+	go h.dispatch()
+	return h, nil
+}
+
+// Items returns the addresses of the items currently registered. Items whose
+// owner already left the bus are skipped.
+func (h *Host) Items() ([]string, error) {
+	v, err := h.conn.Object(watcherName, watcherPath).GetProperty(watcherInterface + ".RegisteredStatusNotifierItems")
+	if err != nil {
+		return nil, fmt.Errorf("get registered items: %w", err)
+	}
+	var registered []string
+	if err := v.Store(&registered); err != nil {
+		return nil, fmt.Errorf("decode registered items: %w", err)
+	}
+	var items []string
+	for _, item := range registered {
+		if h.track(item) {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// Events delivers item changes until the connection closes.
+func (h *Host) Events() <-chan HostEvent {
+	return h.events
+}
+
+func (h *Host) dispatch() {
+	defer close(h.events)
+	for sig := range h.signals {
+		switch {
+		case sig.Name == watcherInterface+".StatusNotifierItemRegistered":
+			if item, ok := signalString(sig); ok && h.track(item) {
+				h.events <- HostEvent{Kind: ItemAdded, Item: item}
+			}
+		case sig.Name == watcherInterface+".StatusNotifierItemUnregistered":
+			if item, ok := signalString(sig); ok {
+				h.untrack(item)
+				h.events <- HostEvent{Kind: ItemRemoved, Item: item}
+			}
+		case strings.HasPrefix(sig.Name, itemInterface+".New"):
+			h.mu.Lock()
+			items := h.owners[sig.Sender]
+			h.mu.Unlock()
+			for _, item := range items {
+				if _, path := SplitAddress(item); path == sig.Path {
+					h.events <- HostEvent{Kind: ItemChanged, Item: item}
+				}
+			}
+		}
+	}
+}
+
+// track maps the unique name owning item to it, as item signals carry the
+// sender's unique name rather than the name it registered with. It reports
+// false for items without an owner, which are gone already.
+func (h *Host) track(item string) bool {
+	service, _ := SplitAddress(item)
+	owner := service
+	if !strings.HasPrefix(service, ":") {
+		if err := h.conn.BusObject().Call("org.freedesktop.DBus.GetNameOwner", 0, service).Store(&owner); err != nil {
+			slog.Debug("dropping item without owner", "item", item, "err", err)
+			return false
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, known := range h.owners[owner] {
+		if known == item {
+			return true
+		}
+	}
+	h.owners[owner] = append(h.owners[owner], item)
+	return true
+}
+
+func (h *Host) untrack(item string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for owner, items := range h.owners {
+		for idx, known := range items {
+			if known == item {
+				h.owners[owner] = append(items[:idx], items[idx+1:]...)
+				if len(h.owners[owner]) == 0 {
+					delete(h.owners, owner)
+				}
+				return
+			}
+		}
+	}
+}
+
+func signalString(sig *dbus.Signal) (string, bool) {
+	if len(sig.Body) == 0 {
+		return "", false
+	}
+	s, ok := sig.Body[0].(string)
+	return s, ok
+}
+
+// SplitAddress splits a watcher item address such as
+// ":1.42/org/ayatana/NotificationItem/app" into bus name and object path.
+// Addresses without a path use /StatusNotifierItem.
+func SplitAddress(item string) (string, dbus.ObjectPath) {
+	if idx := strings.Index(item, "/"); idx >= 0 {
+		return item[:idx], dbus.ObjectPath(item[idx:])
+	}
+	return item, defaultItemPath
+}
+
+// RemoteItem is a StatusNotifierItem published by another application.
+type RemoteItem struct {
+	obj dbus.BusObject
+}
+
+func NewRemoteItem(conn *dbus.Conn, item string) *RemoteItem {
+	service, path := SplitAddress(item)
+	return &RemoteItem{obj: conn.Object(service, path)}
+}
+
+// Properties reads the item's current properties.
+func (r *RemoteItem) Properties() (Properties, error) {
+	var values map[string]dbus.Variant
+	if err := r.obj.Call("org.freedesktop.DBus.Properties.GetAll", 0, itemInterface).Store(&values); err != nil {
+		return Properties{}, fmt.Errorf("get properties: %w", err)
+	}
+	var props Properties
+	store := func(name string, dst interface{}) {
+		if v, ok := values[name]; ok {
+			if err := v.Store(dst); err != nil {
+				slog.Debug("decode item property", "property", name, "err", err)
+			}
+		}
+	}
+	store("Category", &props.Category)
+	store("Id", &props.ID)
+	store("Title", &props.Title)
+	store("Status", &props.Status)
+	store("WindowId", &props.WindowID)
+	store("IconName", &props.IconName)
+	store("IconPixmap", &props.IconPixmap)
+	store("ItemIsMenu", &props.ItemIsMenu)
+	store("Menu", &props.Menu)
+	store("ToolTip", &props.ToolTip)
+	store("AttentionIconPixmap", &props.AttentionIconPixmap)
+	store("AttentionIconName", &props.AttentionIconName)
+	store("IconThemePath", &props.IconThemePath)
+	return props, nil
+}
+
+// The action methods do not wait for the application to reply.
+
+func (r *RemoteItem) Activate(x, y int32) {
+	r.obj.Go(itemInterface+".Activate", dbus.FlagNoReplyExpected, nil, x, y)
+}
+
+func (r *RemoteItem) SecondaryActivate(x, y int32) {
+	r.obj.Go(itemInterface+".SecondaryActivate", dbus.FlagNoReplyExpected, nil, x, y)
+}
+
+func (r *RemoteItem) ContextMenu(x, y int32) {
+	r.obj.Go(itemInterface+".ContextMenu", dbus.FlagNoReplyExpected, nil, x, y)
+}
+
+func (r *RemoteItem) Scroll(delta int32, orientation string) {
+	r.obj.Go(itemInterface+".Scroll", dbus.FlagNoReplyExpected, nil, delta, orientation)
+}
@@ -2,6 +2,7 @@ package sni
 
 import (
 	"fmt"
+	"log/slog"
 	"sync"
 
 	"github.com/godbus/dbus/v5"
@@ -13,14 +14,31 @@ type Pixmap struct {
 	Data   []byte
 }
 
+// ToolTip is the (sa(iiay)ss) tooltip structure. An empty icon is filled in
+// with the item's current IconPixmap.
+type ToolTip struct {
+	IconName    string
+	IconPixmap  []Pixmap
+	Title       string
+	Description string
+}
+
 type Properties struct {
 	Category   string
 	ID         string
 	Title      string
 	Status     string
 	WindowID   uint32
+	IconName   string
 	IconPixmap []Pixmap
 	ItemIsMenu bool
+	Menu       dbus.ObjectPath
+	ToolTip    ToolTip
+
+	AttentionIconPixmap []Pixmap
+	// AttentionIconName and IconThemePath are only read from remote items.
+	AttentionIconName string
+	IconThemePath     string
 }
 
 type ActionHandler interface {
@@ -34,16 +52,37 @@ type Item struct {
 	conn    *dbus.Conn
 	path    dbus.ObjectPath
 	service string
+	log     *slog.Logger
 	handler ActionHandler
+	menu    *Menu
 	mu      sync.RWMutex
 	props   Properties
 }
 
+// Connect opens a private session bus connection for a single item. Items
+// export fixed object paths, so they cannot share a connection.
+func Connect() (*dbus.Conn, error) {
+	conn, err := dbus.SessionBusPrivate()
+	if err != nil {
+		return nil, fmt.Errorf("connect session bus: %w", err)
+	}
+	if err := conn.Auth(nil); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("auth session bus: %w", err)
+	}
+	if err := conn.Hello(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("hello session bus: %w", err)
+	}
+	return conn, nil
+}
+
 func NewItem(conn *dbus.Conn, service string, props Properties, handler ActionHandler) (*Item, error) {
 	if conn == nil {
 		return nil, fmt.Errorf("dbus connection is nil")
 	}
-	reply, err := conn.RequestName(service, dbus.NameFlagDoNotQueue)
+	// A replacing instance takes the name over, so hosts keep the item.
+	reply, err := conn.RequestName(service, dbus.NameFlagAllowReplacement|dbus.NameFlagReplaceExisting|dbus.NameFlagDoNotQueue)
 	if err != nil {
 		return nil, fmt.Errorf("request name: %w", err)
 	}
@@ -55,6 +94,7 @@ func NewItem(conn *dbus.Conn, service string, props Properties, handler ActionHa
 		conn:    conn,
 		path:    dbus.ObjectPath("/StatusNotifierItem"),
 		service: service,
+		log:     slog.With("service", service),
 		props:   props,
 		handler: handler,
 	}
@@ -63,6 +103,9 @@ func NewItem(conn *dbus.Conn, service string, props Properties, handler ActionHa
 	conn.Export(item, item.path, "org.freedesktop.DBus.Properties")
 	conn.Export(item, item.path, "org.freedesktop.DBus.Introspectable")
 
+	item.menu = newMenu(conn, item.path+"/Menu", item.log)
+	item.props.Menu = item.menu.Path()
+
 	if err := Register(conn, service); err != nil {
 		return nil, err
 	}
@@ -70,10 +113,15 @@ func NewItem(conn *dbus.Conn, service string, props Properties, handler ActionHa
 	return item, nil
 }
 
+// Close unexports the item and its menu and releases the bus name.
 func (i *Item) Close() {
 	if i.conn == nil {
 		return
 	}
+	for _, iface := range []string{"org.kde.StatusNotifierItem", "org.freedesktop.DBus.Properties", "org.freedesktop.DBus.Introspectable"} {
+		i.conn.Export(nil, i.path, iface)
+	}
+	i.menu.unexport()
 	i.conn.ReleaseName(i.service)
 }
 
@@ -83,21 +131,94 @@ func (i *Item) SetHandler(handler ActionHandler) {
 	i.mu.Unlock()
 }
 
+func (i *Item) Service() string {
+	return i.service
+}
+
+func (i *Item) Menu() *Menu {
+	return i.menu
+}
+
 func (i *Item) UpdateIcon(pixmaps []Pixmap) {
 	i.mu.Lock()
 	i.props.IconPixmap = pixmaps
 	i.mu.Unlock()
-	i.conn.Emit(i.path, "org.kde.StatusNotifierItem", "NewIcon")
+	i.emit("NewIcon")
+}
+
+func (i *Item) UpdateIconName(name string) {
+	i.mu.Lock()
+	i.props.IconName = name
+	i.mu.Unlock()
+	i.emit("NewIcon")
+}
+
+// UpdateCategory changes the category. The SNI spec has no change signal for
+// it, so the standard PropertiesChanged signal is sent instead.
+func (i *Item) UpdateCategory(category string) {
+	i.mu.Lock()
+	changed := i.props.Category != category
+	i.props.Category = category
+	i.mu.Unlock()
+	if changed {
+		i.conn.Emit(i.path, "org.freedesktop.DBus.Properties.PropertiesChanged", "org.kde.StatusNotifierItem",
+			map[string]dbus.Variant{"Category": dbus.MakeVariant(category)}, []string{})
+	}
 }
 
 func (i *Item) UpdateTitle(title string) {
 	i.mu.Lock()
 	i.props.Title = title
 	i.mu.Unlock()
-	i.conn.Emit(i.path, "org.kde.StatusNotifierItem", "NewTitle")
+	i.emit("NewTitle")
+}
+
+func (i *Item) Status() string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.props.Status
+}
+
+func (i *Item) UpdateStatus(status string) {
+	i.mu.Lock()
+	changed := i.props.Status != status
+	i.props.Status = status
+	i.mu.Unlock()
+	if changed {
+		i.emit("NewStatus", status)
+	}
+}
+
+func (i *Item) UpdateAttentionIcon(pixmaps []Pixmap) {
+	i.mu.Lock()
+	i.props.AttentionIconPixmap = pixmaps
+	i.mu.Unlock()
+	i.emit("NewAttentionIcon")
+}
+
+func (i *Item) ToolTip() ToolTip {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.props.ToolTip
+}
+
+func (i *Item) UpdateToolTip(tooltip ToolTip) {
+	i.mu.Lock()
+	i.props.ToolTip = tooltip
+	i.mu.Unlock()
+	i.emit("NewToolTip")
+}
+
+// emit sends a StatusNotifierItem signal. Failures only mean the bus went
+// away, which the caller cannot act on.
+func (i *Item) emit(signal string, values ...interface{}) {
+	if err := i.conn.Emit(i.path, "org.kde.StatusNotifierItem."+signal, values...); err != nil {
+		i.log.Debug("emit signal failed", "signal", signal, "err", err)
+	}
 }
 
 func (i *Item) Activate(x, y int32) *dbus.Error {
+	i.log.Debug("Activate", "x", x, "y", y)
 	i.mu.RLock()
 	h := i.handler
 	i.mu.RUnlock()
@@ -108,6 +229,7 @@ func (i *Item) Activate(x, y int32) *dbus.Error {
 }
 
 func (i *Item) SecondaryActivate(x, y int32) *dbus.Error {
+	i.log.Debug("SecondaryActivate", "x", x, "y", y)
 	i.mu.RLock()
 	h := i.handler
 	i.mu.RUnlock()
@@ -118,6 +240,7 @@ func (i *Item) SecondaryActivate(x, y int32) *dbus.Error {
 }
 
 func (i *Item) ContextMenu(x, y int32) *dbus.Error {
+	i.log.Debug("ContextMenu", "x", x, "y", y)
 	i.mu.RLock()
 	h := i.handler
 	i.mu.RUnlock()
@@ -128,6 +251,7 @@ func (i *Item) ContextMenu(x, y int32) *dbus.Error {
 }
 
 func (i *Item) Scroll(delta int32, orientation string) *dbus.Error {
+	i.log.Debug("Scroll", "delta", delta, "orientation", orientation)
 	i.mu.RLock()
 	h := i.handler
 	i.mu.RUnlock()
@@ -160,8 +284,13 @@ func (i *Item) GetAll(iface string) (map[string]dbus.Variant, *dbus.Error) {
 		"Title":      dbus.MakeVariant(i.props.Title),
 		"Status":     dbus.MakeVariant(i.props.Status),
 		"WindowId":   dbus.MakeVariant(i.props.WindowID),
+		"IconName":   dbus.MakeVariant(i.props.IconName),
 		"IconPixmap": dbus.MakeVariant(i.props.IconPixmap),
 		"ItemIsMenu": dbus.MakeVariant(i.props.ItemIsMenu),
+		"Menu":       dbus.MakeVariant(i.props.Menu),
+		"ToolTip":    dbus.MakeVariant(i.toolTip()),
+
+		"AttentionIconPixmap": dbus.MakeVariant(i.attentionIcon()),
 	}, nil
 }
 
@@ -183,11 +312,39 @@ func (i *Item) getProperty(prop string) interface{} {
 		return i.props.Status
 	case "WindowId":
 		return i.props.WindowID
+	case "IconName":
+		return i.props.IconName
 	case "IconPixmap":
 		return i.props.IconPixmap
 	case "ItemIsMenu":
 		return i.props.ItemIsMenu
+	case "Menu":
+		return i.props.Menu
+	case "ToolTip":
+		return i.toolTip()
+	case "AttentionIconPixmap":
+		return i.attentionIcon()
 	default:
 		return nil
 	}
 }
+
+// toolTip must be called with i.mu held.
+func (i *Item) toolTip() ToolTip {
+	tooltip := i.props.ToolTip
+	if tooltip.IconName == "" && len(tooltip.IconPixmap) == 0 {
+		tooltip.IconPixmap = i.props.IconPixmap
+	}
+	if tooltip.IconPixmap == nil {
+		tooltip.IconPixmap = []Pixmap{}
+	}
+	return tooltip
+}
+
+// attentionIcon must be called with i.mu held.
+func (i *Item) attentionIcon() []Pixmap {
+	if i.props.AttentionIconPixmap == nil {
+		return []Pixmap{}
+	}
+	return i.props.AttentionIconPixmap
+}
@@ -0,0 +1,290 @@
+package sni
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const menuInterface = "com.canonical.dbusmenu"
+
+type MenuItem struct {
+	ID        int32
+	Label     string
+	Enabled   bool
+	Separator bool
+	// IconData is a PNG image shown next to (or instead of) the label.
+	IconData []byte
+}
+
+type MenuHandler interface {
+	MenuClicked(id int32)
+	// MenuAboutToShow is called before the menu is displayed and reports
+	// whether the entries were changed as a result.
+	MenuAboutToShow() bool
+	MenuClosed()
+}
+
+// menuLayout is the (ia{sv}av) structure returned by GetLayout.
+type menuLayout struct {
+	ID         int32
+	Properties map[string]dbus.Variant
+	Children   []dbus.Variant
+}
+
+type menuItemProperties struct {
+	ID         int32
+	Properties map[string]dbus.Variant
+}
+
+type menuEvent struct {
+	ID        int32
+	EventID   string
+	Data      dbus.Variant
+	Timestamp uint32
+}
+
+// Menu implements com.canonical.dbusmenu for a flat list of entries.
+type Menu struct {
+	conn     *dbus.Conn
+	path     dbus.ObjectPath
+	log      *slog.Logger
+	mu       sync.RWMutex
+	revision uint32
+	items    []MenuItem
+	handler  MenuHandler
+}
+
+func newMenu(conn *dbus.Conn, path dbus.ObjectPath, log *slog.Logger) *Menu {
+	m := &Menu{
+		conn: conn,
+		path: path,
+		log:  log,
+	}
+	conn.Export(m, m.path, menuInterface)
+	conn.Export(m, m.path, "org.freedesktop.DBus.Properties")
+	conn.Export(m, m.path, "org.freedesktop.DBus.Introspectable")
+	return m
+}
+
+// unexport removes the menu from the connection.
+func (m *Menu) unexport() {
+	for _, iface := range []string{menuInterface, "org.freedesktop.DBus.Properties", "org.freedesktop.DBus.Introspectable"} {
+		m.conn.Export(nil, m.path, iface)
+	}
+}
+
+func (m *Menu) Path() dbus.ObjectPath {
+	return m.path
+}
+
+func (m *Menu) SetHandler(handler MenuHandler) {
+	m.mu.Lock()
+	m.handler = handler
+	m.mu.Unlock()
+}
+
+// SetItems replaces the menu entries and emits LayoutUpdated.
+func (m *Menu) SetItems(items []MenuItem) {
+	m.mu.Lock()
+	m.items = items
+	m.revision++
+	revision := m.revision
+	m.mu.Unlock()
+	if err := m.conn.Emit(m.path, menuInterface+".LayoutUpdated", revision, int32(0)); err != nil {
+		m.log.Debug("emit signal failed", "signal", "LayoutUpdated", "err", err)
+	}
+}
+
+func (m *Menu) GetLayout(parentID int32, recursionDepth int32, propertyNames []string) (uint32, menuLayout, *dbus.Error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if parentID != 0 {
+		item, ok := m.find(parentID)
+		if !ok {
+			return 0, menuLayout{}, dbus.MakeFailedError(fmt.Errorf("unknown menu item: %d", parentID))
+		}
+		return m.revision, menuLayout{ID: item.ID, Properties: filterProperties(item.properties(), propertyNames), Children: []dbus.Variant{}}, nil
+	}
+
+	root := menuLayout{
+		ID:         0,
+		Properties: filterProperties(map[string]dbus.Variant{"children-display": dbus.MakeVariant("submenu")}, propertyNames),
+		Children:   []dbus.Variant{},
+	}
+	if recursionDepth == 0 {
+		return m.revision, root, nil
+	}
+	for _, item := range m.items {
+		child := menuLayout{ID: item.ID, Properties: filterProperties(item.properties(), propertyNames), Children: []dbus.Variant{}}
+		root.Children = append(root.Children, dbus.MakeVariant(child))
+	}
+	return m.revision, root, nil
+}
+
+func (m *Menu) GetGroupProperties(ids []int32, propertyNames []string) ([]menuItemProperties, *dbus.Error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := []menuItemProperties{}
+	if len(ids) == 0 {
+		for _, item := range m.items {
+			result = append(result, menuItemProperties{ID: item.ID, Properties: filterProperties(item.properties(), propertyNames)})
+		}
+		return result, nil
+	}
+	for _, id := range ids {
+		if item, ok := m.find(id); ok {
+			result = append(result, menuItemProperties{ID: id, Properties: filterProperties(item.properties(), propertyNames)})
+		}
+	}
+	return result, nil
+}
+
+func (m *Menu) GetProperty(id int32, name string) (dbus.Variant, *dbus.Error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	item, ok := m.find(id)
+	if !ok {
+		return dbus.Variant{}, dbus.MakeFailedError(fmt.Errorf("unknown menu item: %d", id))
+	}
+	value, ok := item.properties()[name]
+	if !ok {
+		return dbus.Variant{}, dbus.MakeFailedError(fmt.Errorf("unknown property: %s", name))
+	}
+	return value, nil
+}
+
+func (m *Menu) Event(id int32, eventID string, data dbus.Variant, timestamp uint32) *dbus.Error {
+	m.log.Debug("menu event", "id", id, "event", eventID)
+	m.mu.RLock()
+	h := m.handler
+	_, ok := m.find(id)
+	m.mu.RUnlock()
+	if h == nil {
+		return nil
+	}
+	switch eventID {
+	case "clicked":
+		if !ok {
+			return dbus.MakeFailedError(fmt.Errorf("unknown menu item: %d", id))
+		}
+		h.MenuClicked(id)
+	case "closed":
+		if id == 0 {
+			h.MenuClosed()
+		}
+	}
+	return nil
+}
+
+func (m *Menu) EventGroup(events []menuEvent) ([]int32, *dbus.Error) {
+	idErrors := []int32{}
+	for _, ev := range events {
+		if err := m.Event(ev.ID, ev.EventID, ev.Data, ev.Timestamp); err != nil {
+			idErrors = append(idErrors, ev.ID)
+		}
+	}
+	return idErrors, nil
+}
+
+func (m *Menu) AboutToShow(id int32) (bool, *dbus.Error) {
+	if id != 0 {
+		return false, nil
+	}
+	m.mu.RLock()
+	h := m.handler
+	m.mu.RUnlock()
+	if h == nil {
+		return false, nil
+	}
+	return h.MenuAboutToShow(), nil
+}
+
+func (m *Menu) AboutToShowGroup(ids []int32) ([]int32, []int32, *dbus.Error) {
+	updates := []int32{}
+	for _, id := range ids {
+		if needUpdate, _ := m.AboutToShow(id); needUpdate {
+			updates = append(updates, id)
+		}
+	}
+	return updates, []int32{}, nil
+}
+
+func (m *Menu) Get(iface, prop string) (dbus.Variant, *dbus.Error) {
+	if iface != menuInterface {
+		return dbus.Variant{}, dbus.MakeFailedError(fmt.Errorf("unknown interface: %s", iface))
+	}
+	value, ok := menuProperties()[prop]
+	if !ok {
+		return dbus.Variant{}, dbus.MakeFailedError(fmt.Errorf("unknown property: %s", prop))
+	}
+	return value, nil
+}
+
+func (m *Menu) Set(iface, prop string, value dbus.Variant) *dbus.Error {
+	return dbus.MakeFailedError(fmt.Errorf("property %s is read-only", prop))
+}
+
+func (m *Menu) GetAll(iface string) (map[string]dbus.Variant, *dbus.Error) {
+	if iface != menuInterface {
+		return nil, dbus.MakeFailedError(fmt.Errorf("unknown interface: %s", iface))
+	}
+	return menuProperties(), nil
+}
+
+func (m *Menu) Introspect() (string, *dbus.Error) {
+	return menuIntrospectionXML, nil
+}
+
+// find must be called with m.mu held.
+func (m *Menu) find(id int32) (MenuItem, bool) {
+	for _, item := range m.items {
+		if item.ID == id {
+			return item, true
+		}
+	}
+	return MenuItem{}, false
+}
+
+func (item MenuItem) properties() map[string]dbus.Variant {
+	if item.Separator {
+		return map[string]dbus.Variant{
+			"type": dbus.MakeVariant("separator"),
+		}
+	}
+	props := map[string]dbus.Variant{
+		"label":   dbus.MakeVariant(item.Label),
+		"enabled": dbus.MakeVariant(item.Enabled),
+		"visible": dbus.MakeVariant(true),
+	}
+	if len(item.IconData) > 0 {
+		props["icon-data"] = dbus.MakeVariant(item.IconData)
+	}
+	return props
+}
+
+func menuProperties() map[string]dbus.Variant {
+	return map[string]dbus.Variant{
+		"Version":       dbus.MakeVariant(uint32(3)),
+		"TextDirection": dbus.MakeVariant("ltr"),
+		"Status":        dbus.MakeVariant("normal"),
+		"IconThemePath": dbus.MakeVariant([]string{}),
+	}
+}
+
+func filterProperties(props map[string]dbus.Variant, names []string) map[string]dbus.Variant {
+	if len(names) == 0 {
+		return props
+	}
+	filtered := make(map[string]dbus.Variant, len(names))
+	for _, name := range names {
+		if value, ok := props[name]; ok {
+			filtered[name] = value
+		}
+	}
+	return filtered
+}
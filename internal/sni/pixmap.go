@@ -0,0 +1,30 @@
+package sni
+
+import (
+	"image"
+	"image/color"
+)
+
+// PixmapFromImage converts img to the ARGB32, network byte order layout used
+// by IconPixmap.
+func PixmapFromImage(img image.Image) Pixmap {
+	b := img.Bounds()
+	data := make([]byte, 0, b.Dx()*b.Dy()*4)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			data = append(data, c.A, c.R, c.G, c.B)
+		}
+	}
+	return Pixmap{Width: int32(b.Dx()), Height: int32(b.Dy()), Data: data}
+}
+
+// ImageFromPixmap decodes an IconPixmap entry back into an image.
+func ImageFromPixmap(p Pixmap) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, int(p.Width), int(p.Height)))
+	for idx := 0; idx+4 <= len(p.Data) && idx/4 < int(p.Width*p.Height); idx += 4 {
+		x, y := (idx/4)%int(p.Width), (idx/4)/int(p.Width)
+		img.SetNRGBA(x, y, color.NRGBA{A: p.Data[idx], R: p.Data[idx+1], G: p.Data[idx+2], B: p.Data[idx+3]})
+	}
+	return img
+}
@@ -1,7 +1,11 @@
 package sni
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
 
 	"github.com/godbus/dbus/v5"
 )
@@ -18,3 +22,152 @@ func Register(conn *dbus.Conn, service string) error {
 	}
 	return nil
 }
+
+// ErrWatcherRunning is returned by NewWatcher when another process already
+// provides the StatusNotifierWatcher.
+var ErrWatcherRunning = errors.New("a StatusNotifierWatcher is already running")
+
+// Watcher is a minimal StatusNotifierWatcher, for sessions where no panel
+// provides one.
+type Watcher struct {
+	conn *dbus.Conn
+
+	mu    sync.Mutex
+	items []string
+	hosts []string
+}
+
+// NewWatcher claims the watcher name on conn and serves it until conn is
+// closed.
+func NewWatcher(conn *dbus.Conn) (*Watcher, error) {
+	reply, err := conn.RequestName(watcherName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		return nil, fmt.Errorf("request name: %w", err)
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		return nil, ErrWatcherRunning
+	}
+	w := &Watcher{conn: conn}
+	conn.Export(w, watcherPath, watcherInterface)
+	conn.Export(w, watcherPath, "org.freedesktop.DBus.Properties")
+	conn.Export(w, watcherPath, "org.freedesktop.DBus.Introspectable")
+
+	// Drop registrations of clients that leave the bus.
+	if err := conn.AddMatchSignal(
+		dbus.WithMatchInterface("org.freedesktop.DBus"),
+		dbus.WithMatchMember("NameOwnerChanged"),
+	); err != nil {
+		return nil, fmt.Errorf("match NameOwnerChanged: %w", err)
+	}
+	signals := make(chan *dbus.Signal, 16)
+	conn.Signal(signals)
+	go w.watchOwners(signals)
+	return w, nil
+}
+
+func (w *Watcher) RegisterStatusNotifierItem(sender dbus.Sender, service string) *dbus.Error {
+	// Items register either their bus name or, like libappindicator, an
+	// object path on their unique name.
+	item := service + string(defaultItemPath)
+	if strings.HasPrefix(service, "/") {
+		item = string(sender) + service
+	}
+	w.mu.Lock()
+	for _, known := range w.items {
+		if known == item {
+			w.mu.Unlock()
+			return nil
+		}
+	}
+	w.items = append(w.items, item)
+	w.mu.Unlock()
+	slog.Debug("item registered", "item", item)
+	w.conn.Emit(watcherPath, watcherInterface+".StatusNotifierItemRegistered", item)
+	return nil
+}
+
+func (w *Watcher) RegisterStatusNotifierHost(sender dbus.Sender, service string) *dbus.Error {
+	w.mu.Lock()
+	for _, known := range w.hosts {
+		if known == string(sender) {
+			w.mu.Unlock()
+			return nil
+		}
+	}
+	w.hosts = append(w.hosts, string(sender))
+	first := len(w.hosts) == 1
+	w.mu.Unlock()
+	if first {
+		w.conn.Emit(watcherPath, watcherInterface+".StatusNotifierHostRegistered")
+	}
+	return nil
+}
+
+func (w *Watcher) Get(iface, prop string) (dbus.Variant, *dbus.Error) {
+	props, err := w.GetAll(iface)
+	if err != nil {
+		return dbus.Variant{}, err
+	}
+	v, ok := props[prop]
+	if !ok {
+		return dbus.Variant{}, dbus.MakeFailedError(fmt.Errorf("unknown property: %s", prop))
+	}
+	return v, nil
+}
+
+func (w *Watcher) Set(iface, prop string, value dbus.Variant) *dbus.Error {
+	return dbus.MakeFailedError(fmt.Errorf("property %s is read-only", prop))
+}
+
+func (w *Watcher) GetAll(iface string) (map[string]dbus.Variant, *dbus.Error) {
+	if iface != watcherInterface {
+		return nil, dbus.MakeFailedError(fmt.Errorf("unknown interface: %s", iface))
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return map[string]dbus.Variant{
+		"RegisteredStatusNotifierItems":  dbus.MakeVariant(append([]string{}, w.items...)),
+		"IsStatusNotifierHostRegistered": dbus.MakeVariant(len(w.hosts) > 0),
+		"ProtocolVersion":                dbus.MakeVariant(int32(0)),
+	}, nil
+}
+
+func (w *Watcher) Introspect() (string, *dbus.Error) {
+	return watcherIntrospectionXML, nil
+}
+
+func (w *Watcher) watchOwners(signals chan *dbus.Signal) {
+	for sig := range signals {
+		if sig.Name != "org.freedesktop.DBus.NameOwnerChanged" || len(sig.Body) < 3 {
+			continue
+		}
+		name, _ := sig.Body[0].(string)
+		newOwner, _ := sig.Body[2].(string)
+		if newOwner != "" {
+			continue
+		}
+		var gone []string
+		w.mu.Lock()
+		items := w.items[:0]
+		for _, item := range w.items {
+			if service, _ := SplitAddress(item); service == name {
+				gone = append(gone, item)
+				continue
+			}
+			items = append(items, item)
+		}
+		w.items = items
+		hosts := w.hosts[:0]
+		for _, host := range w.hosts {
+			if host != name {
+				hosts = append(hosts, host)
+			}
+		}
+		w.hosts = hosts
+		w.mu.Unlock()
+		for _, item := range gone {
+			slog.Debug("item unregistered", "item", item)
+			w.conn.Emit(watcherPath, watcherInterface+".StatusNotifierItemUnregistered", item)
+		}
+	}
+}
@@ -17,6 +17,15 @@ type Atoms struct {
 	NetWMName     xproto.Atom
 	UTF8String    xproto.Atom
 	NetWMIcon     xproto.Atom
+	NetActiveWin  xproto.Atom
+	NetClientList xproto.Atom
+	NetWMPid      xproto.Atom
+	ClientLeader  xproto.Atom
+	TrayVisual    xproto.Atom
+
+	WMChangeState         xproto.Atom
+	NetWMWindowType       xproto.Atom
+	NetWMWindowTypeNormal xproto.Atom
 }
 
 func internAtom(conn *xgb.Conn, name string) (xproto.Atom, error) {
@@ -64,6 +73,38 @@ func InternAtoms(conn *xgb.Conn) (Atoms, error) {
 	if err != nil {
 		return Atoms{}, err
 	}
+	netActiveWin, err := internAtom(conn, "_NET_ACTIVE_WINDOW")
+	if err != nil {
+		return Atoms{}, err
+	}
+	netClientList, err := internAtom(conn, "_NET_CLIENT_LIST")
+	if err != nil {
+		return Atoms{}, err
+	}
+	netWMPid, err := internAtom(conn, "_NET_WM_PID")
+	if err != nil {
+		return Atoms{}, err
+	}
+	clientLeader, err := internAtom(conn, "WM_CLIENT_LEADER")
+	if err != nil {
+		return Atoms{}, err
+	}
+	trayVisual, err := internAtom(conn, "_NET_SYSTEM_TRAY_VISUAL")
+	if err != nil {
+		return Atoms{}, err
+	}
+	wmChangeState, err := internAtom(conn, "WM_CHANGE_STATE")
+	if err != nil {
+		return Atoms{}, err
+	}
+	netWMWindowType, err := internAtom(conn, "_NET_WM_WINDOW_TYPE")
+	if err != nil {
+		return Atoms{}, err
+	}
+	netWMWindowTypeNormal, err := internAtom(conn, "_NET_WM_WINDOW_TYPE_NORMAL")
+	if err != nil {
+		return Atoms{}, err
+	}
 
 	return Atoms{
 		TraySelection: traySelection,
@@ -75,5 +116,14 @@ func InternAtoms(conn *xgb.Conn) (Atoms, error) {
 		NetWMName:     netWMName,
 		UTF8String:    utf8String,
 		NetWMIcon:     netWMIcon,
+		NetActiveWin:  netActiveWin,
+		NetClientList: netClientList,
+		NetWMPid:      netWMPid,
+		ClientLeader:  clientLeader,
+		TrayVisual:    trayVisual,
+
+		WMChangeState:         wmChangeState,
+		NetWMWindowType:       netWMWindowType,
+		NetWMWindowTypeNormal: netWMWindowTypeNormal,
 	}, nil
 }
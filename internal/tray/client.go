@@ -0,0 +1,157 @@
+package tray
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/res"
+	"github.com/jezek/xgb/xproto"
+)
+
+// App describes the application owning a docked icon.
+type App struct {
+	PID        uint32
+	Executable string
+	Cmdline    []string
+	// Name, DesktopID and IconName come from the matching .desktop file and
+	// are empty when none was found.
+	Name      string
+	DesktopID string
+	IconName  string
+}
+
+// App resolves the process and installed application owning the icon.
+func (i *Icon) App() App {
+	pid := i.PID()
+	app := App{PID: pid, Executable: processExecutable(pid), Cmdline: processCmdline(pid)}
+
+	instance, class := i.WMClass()
+	exe := app.Executable
+	if exe == "" && len(app.Cmdline) > 0 {
+		exe = app.Cmdline[0]
+	}
+	if entry, ok := FindDesktopEntry(instance, class, exe); ok {
+		app.Name = entry.Name
+		app.DesktopID = entry.ID
+		app.IconName = entry.Icon
+	}
+	return app
+}
+
+// WMClass returns the WM_CLASS instance and class names of the icon, falling
+// back to the application's top-level windows when the icon has none.
+func (i *Icon) WMClass() (instance string, class string) {
+	if instance, class, err := getWMClass(i.conn, i.Window); err == nil && (instance != "" || class != "") {
+		return instance, class
+	}
+	windows, err := i.ClientWindows()
+	if err != nil {
+		return "", ""
+	}
+	for _, win := range windows {
+		if instance, class, err := getWMClass(i.conn, win); err == nil && (instance != "" || class != "") {
+			return instance, class
+		}
+	}
+	return "", ""
+}
+
+// PID returns the _NET_WM_PID of the icon or of its application's windows,
+// falling back to asking the server through the X-Resource extension.
+// It returns 0 when unknown.
+func (i *Icon) PID() uint32 {
+	if pid, err := getCardinalProperty(i.conn, i.Window, i.atoms.NetWMPid); err == nil && pid != 0 {
+		return pid
+	}
+	if windows, err := i.ClientWindows(); err == nil {
+		for _, win := range windows {
+			if pid, err := getCardinalProperty(i.conn, win, i.atoms.NetWMPid); err == nil && pid != 0 {
+				return pid
+			}
+		}
+	}
+	if i.xres {
+		return queryClientPID(i.conn, i.Window)
+	}
+	return 0
+}
+
+// Executable returns the path of the process owning the icon, or "" when the
+// pid is unknown or the process is not local.
+func (i *Icon) Executable() string {
+	return processExecutable(i.PID())
+}
+
+// Cmdline returns the command line of the process owning the icon.
+func (i *Icon) Cmdline() []string {
+	return processCmdline(i.PID())
+}
+
+func processExecutable(pid uint32) string {
+	if pid == 0 {
+		return ""
+	}
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return ""
+	}
+	// Replaced binaries (e.g. after an upgrade) are reported with a suffix.
+	return strings.TrimSuffix(exe, " (deleted)")
+}
+
+func processCmdline(pid uint32) []string {
+	if pid == 0 {
+		return nil
+	}
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+}
+
+// queryClientPID asks the X server for the pid of the local client owning win.
+func queryClientPID(conn *xgb.Conn, win xproto.Window) uint32 {
+	spec := res.ClientIdSpec{Client: uint32(win), Mask: res.ClientIdMaskLocalClientPID}
+	reply, err := res.QueryClientIds(conn, 1, []res.ClientIdSpec{spec}).Reply()
+	if err != nil {
+		return 0
+	}
+	for _, id := range reply.Ids {
+		if id.Spec.Mask&res.ClientIdMaskLocalClientPID != 0 && len(id.Value) > 0 {
+			return id.Value[0]
+		}
+	}
+	return 0
+}
+
+func getWMClass(conn *xgb.Conn, win xproto.Window) (string, string, error) {
+	reply, err := xproto.GetProperty(conn, false, win, xproto.AtomWmClass, xproto.AtomString, 0, (1<<32)-1).Reply()
+	if err != nil {
+		return "", "", err
+	}
+	if reply == nil || len(reply.Value) == 0 {
+		return "", "", nil
+	}
+	parts := strings.SplitN(strings.TrimRight(string(reply.Value), "\x00"), "\x00", 2)
+	if len(parts) == 1 {
+		return parts[0], "", nil
+	}
+	return parts[0], parts[1], nil
+}
+
+func getCardinalProperty(conn *xgb.Conn, win xproto.Window, atom xproto.Atom) (uint32, error) {
+	if atom == xproto.AtomNone {
+		return 0, nil
+	}
+	reply, err := xproto.GetProperty(conn, false, win, atom, xproto.AtomCardinal, 0, 1).Reply()
+	if err != nil {
+		return 0, err
+	}
+	if reply == nil || reply.Format != 32 || len(reply.Value) < 4 {
+		return 0, nil
+	}
+	return xgb.Get32(reply.Value), nil
+}
@@ -0,0 +1,204 @@
+package tray
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DesktopEntry is the subset of a freedesktop .desktop file used to identify
+// an application.
+type DesktopEntry struct {
+	ID             string
+	Path           string
+	Name           string
+	Icon           string
+	Exec           string
+	StartupWMClass string
+}
+
+// FindDesktopEntry looks for the installed application matching the given
+// WM_CLASS and executable. StartupWMClass matches win over desktop ids, which
+// win over Exec matches.
+func FindDesktopEntry(instance, class, exe string) (DesktopEntry, bool) {
+	entries := desktopEntries()
+	names := []string{}
+	for _, name := range []string{class, instance} {
+		if name != "" {
+			names = append(names, strings.ToLower(name))
+		}
+	}
+
+	for _, entry := range entries {
+		for _, name := range names {
+			if entry.StartupWMClass != "" && strings.ToLower(entry.StartupWMClass) == name {
+				return entry, true
+			}
+		}
+	}
+	for _, entry := range entries {
+		id := strings.ToLower(strings.TrimSuffix(entry.ID, ".desktop"))
+		for _, name := range names {
+			// Reverse-DNS ids such as org.telegram.desktop.desktop end in the
+			// application name.
+			if id == name || strings.HasSuffix(id, "."+name) {
+				return entry, true
+			}
+		}
+	}
+	if exe != "" {
+		base := filepath.Base(exe)
+		for _, entry := range entries {
+			if execBase(entry.Exec) == base {
+				return entry, true
+			}
+		}
+	}
+	return DesktopEntry{}, false
+}
+
+// applicationDirs returns the XDG application directories in precedence order.
+func applicationDirs() []string {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			dataHome = filepath.Join(home, ".local", "share")
+		}
+	}
+	dataDirs := os.Getenv("XDG_DATA_DIRS")
+	if dataDirs == "" {
+		dataDirs = "/usr/local/share:/usr/share"
+	}
+
+	var dirs []string
+	if dataHome != "" {
+		dirs = append(dirs, filepath.Join(dataHome, "applications"))
+	}
+	for _, dir := range filepath.SplitList(dataDirs) {
+		if dir != "" {
+			dirs = append(dirs, filepath.Join(dir, "applications"))
+		}
+	}
+	return dirs
+}
+
+// Parsed desktop entries are cached until ResetDesktopEntries.
+var desktopCache struct {
+	sync.Mutex
+	entries []DesktopEntry
+	loaded  bool
+}
+
+// ResetDesktopEntries drops the cached desktop entries, so applications
+// installed since are found.
+func ResetDesktopEntries() {
+	desktopCache.Lock()
+	defer desktopCache.Unlock()
+	desktopCache.entries = nil
+	desktopCache.loaded = false
+}
+
+func desktopEntries() []DesktopEntry {
+	desktopCache.Lock()
+	defer desktopCache.Unlock()
+	if !desktopCache.loaded {
+		desktopCache.entries = loadDesktopEntries()
+		desktopCache.loaded = true
+	}
+	return desktopCache.entries
+}
+
+func loadDesktopEntries() []DesktopEntry {
+	seen := make(map[string]bool)
+	var entries []DesktopEntry
+	for _, dir := range applicationDirs() {
+		_ = filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !strings.HasSuffix(path, ".desktop") {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return nil
+			}
+			id := strings.ReplaceAll(rel, string(filepath.Separator), "-")
+			// Entries earlier in the search path shadow later ones.
+			if seen[id] {
+				return nil
+			}
+			seen[id] = true
+			entry, ok := parseDesktopEntry(path)
+			if !ok {
+				return nil
+			}
+			entry.ID = id
+			entries = append(entries, entry)
+			return nil
+		})
+	}
+	return entries
+}
+
+func parseDesktopEntry(path string) (DesktopEntry, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return DesktopEntry{}, false
+	}
+	defer f.Close()
+
+	entry := DesktopEntry{Path: path}
+	inMain := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			inMain = line == "[Desktop Entry]"
+			continue
+		}
+		if !inMain {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Type":
+			if value != "Application" {
+				return DesktopEntry{}, false
+			}
+		case "Hidden":
+			if value == "true" {
+				return DesktopEntry{}, false
+			}
+		case "Name":
+			entry.Name = value
+		case "Icon":
+			entry.Icon = value
+		case "Exec":
+			entry.Exec = value
+		case "StartupWMClass":
+			entry.StartupWMClass = value
+		}
+	}
+	return entry, entry.Name != ""
+}
+
+// execBase returns the program name run by an Exec= line, skipping env(1)
+// wrappers and variable assignments.
+func execBase(exec string) string {
+	for _, field := range strings.Fields(exec) {
+		field = strings.Trim(field, `"'`)
+		if field == "env" || strings.HasSuffix(field, "/env") || strings.Contains(field, "=") {
+			continue
+		}
+		return filepath.Base(field)
+	}
+	return ""
+}
@@ -0,0 +1,167 @@
+package tray
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/damage"
+	"github.com/jezek/xgb/xproto"
+
+	"github.com/bnema/xtrayhide/internal/logging"
+)
+
+const (
+	iconEventMask = xproto.EventMaskStructureNotify | xproto.EventMaskPropertyChange | xproto.EventMaskExposure
+
+	// When an icon is mapped for a capture, the capture waits up to
+	// paintTimeout for it to draw, and until it stopped drawing for
+	// paintSettle.
+	paintTimeout = 100 * time.Millisecond
+	paintSettle  = 10 * time.Millisecond
+)
+
+// dispatch routes an X event to the manager or to the icon it concerns.
+func (m *Manager) dispatch(ev xgb.Event) {
+	switch e := ev.(type) {
+	case xproto.ClientMessageEvent:
+		m.handleClientMessage(e)
+	case xproto.DestroyNotifyEvent:
+		m.handleDestroy(e)
+	case xproto.MapNotifyEvent:
+		m.handleMap(e)
+	case xproto.PropertyNotifyEvent:
+		m.handleProperty(e)
+	case xproto.ReparentNotifyEvent:
+		m.handleReparent(e)
+	case xproto.ConfigureRequestEvent:
+		if icon, ok := m.icons[e.Window]; ok {
+			icon.handleConfigureRequest(e)
+		}
+	case xproto.ConfigureNotifyEvent:
+		if icon, ok := m.icons[e.Window]; ok && e.Event == e.Window {
+			icon.handleConfigure(e)
+		}
+	case xproto.MapRequestEvent:
+		// XEmbed lets the embedder decide; icons stay hidden.
+		if icon, ok := m.icons[e.Window]; ok {
+			icon.log.Debug("icon asked to be mapped, keeping it hidden")
+		}
+	case xproto.ExposeEvent:
+		if icon := m.iconOf(e.Window); icon != nil && e.Count == 0 {
+			icon.handleContent()
+		}
+	case damage.NotifyEvent:
+		if icon, ok := m.icons[xproto.Window(e.Drawable)]; ok {
+			damage.Subtract(m.Conn, e.Damage, 0, 0)
+			select {
+			case icon.painted <- struct{}{}:
+			default:
+			}
+			icon.handleContent()
+		}
+	}
+}
+
+// iconOf returns the icon whose window or container is win.
+func (m *Manager) iconOf(win xproto.Window) *Icon {
+	if icon, ok := m.icons[win]; ok {
+		return icon
+	}
+	for _, icon := range m.icons {
+		if icon.Container == win {
+			return icon
+		}
+	}
+	return nil
+}
+
+func (m *Manager) newIcon(win, container xproto.Window) *Icon {
+	icon := &Icon{
+		conn:      m.Conn,
+		atoms:     m.Atoms,
+		root:      m.Root,
+		Window:    win,
+		Container: container,
+		composite: m.composite,
+		xres:      m.xres,
+		xtest:     m.xtest,
+		log:       slog.With(logging.Window(uint32(win))),
+		painted:   make(chan struct{}, 1),
+	}
+	// Damage reports when the client actually draws, which Expose does not.
+	if m.damage {
+		if id, err := damage.NewDamageId(m.Conn); err == nil {
+			if err := damage.CreateChecked(m.Conn, id, xproto.Drawable(win), damage.ReportLevelNonEmpty).Check(); err == nil {
+				icon.damage = id
+			} else {
+				icon.log.Debug("watch icon damage failed", "err", err)
+			}
+		}
+	}
+	return icon
+}
+
+// handleReparent drops icons whose client moved its window out of our
+// container, to embed it elsewhere or to stop being a tray icon.
+func (m *Manager) handleReparent(ev xproto.ReparentNotifyEvent) {
+	icon, ok := m.icons[ev.Window]
+	if !ok || ev.Event != ev.Window || ev.Parent == icon.Container {
+		return
+	}
+	icon.log.Debug("icon window reparented away", "parent", fmt.Sprintf("0x%x", ev.Parent))
+	xproto.ChangeSaveSet(m.Conn, xproto.SetModeDelete, icon.Window)
+	if icon.damage != 0 {
+		damage.Destroy(m.Conn, icon.damage)
+	}
+	xproto.DestroyWindow(m.Conn, icon.Container)
+	m.removeIcon(icon)
+}
+
+// SetContentHandler registers fn to be called from the event loop when the
+// icon draws while it is shown, as with Show. Icons are kept unmapped
+// otherwise and do not draw. fn must not block.
+func (i *Icon) SetContentHandler(fn func()) {
+	i.mu.Lock()
+	i.contentHandler = fn
+	i.mu.Unlock()
+}
+
+func (i *Icon) handleContent() {
+	// Events of captures and late ones from the map a capture did are
+	// not changes.
+	if i.capturing.Load() || !i.mapped.Load() {
+		return
+	}
+	i.mu.Lock()
+	fn := i.contentHandler
+	i.mu.Unlock()
+	if fn != nil {
+		fn()
+	}
+}
+
+// waitPainted waits for the icon to draw after it was mapped for a capture.
+// Without the Damage extension there is no way to tell, and it returns at
+// once.
+func (i *Icon) waitPainted() {
+	if i.damage == 0 {
+		return
+	}
+	timeout := time.After(paintTimeout)
+	select {
+	case <-i.painted:
+	case <-timeout:
+		return
+	}
+	for {
+		select {
+		case <-i.painted:
+		case <-time.After(paintSettle):
+			return
+		case <-timeout:
+			return
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package tray
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"log/slog"
+	"sync"
+
+	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/xproto"
+
+	"github.com/bnema/xtrayhide/internal/imaging"
+	"github.com/bnema/xtrayhide/internal/logging"
+)
+
+const defaultDockSize = 22
+
+// Docker is the client side of the system tray protocol: it docks windows of
+// this process into the tray owned by another client, such as stalonetray,
+// trayer or i3bar.
+type Docker struct {
+	Conn  *xgb.Conn
+	Root  xproto.Window
+	Atoms Atoms
+
+	screen *xproto.ScreenInfo
+
+	mu    sync.Mutex
+	owner xproto.Window
+	icons map[xproto.Window]*DockIcon
+}
+
+// DockIcon is a window docked into the tray, painted with an image.
+type DockIcon struct {
+	d      *Docker
+	Window xproto.Window
+	gc     xproto.Gcontext
+	depth  byte
+	log    *slog.Logger
+
+	mu      sync.Mutex
+	width   uint16
+	height  uint16
+	img     image.Image
+	handler func(button uint8, x, y int16)
+}
+
+func NewDocker() (*Docker, error) {
+	conn, err := xgb.NewConn()
+	if err != nil {
+		return nil, fmt.Errorf("connect X11: %w", err)
+	}
+	atoms, err := InternAtoms(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	screen := xproto.Setup(conn).DefaultScreen(conn)
+	d := &Docker{
+		Conn:   conn,
+		Root:   screen.Root,
+		Atoms:  atoms,
+		screen: screen,
+		icons:  make(map[xproto.Window]*DockIcon),
+	}
+
+	// MANAGER announcements are sent to the root window.
+	if err := xproto.ChangeWindowAttributesChecked(conn, d.Root, xproto.CwEventMask, []uint32{xproto.EventMaskStructureNotify}).Check(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("select root events: %w", err)
+	}
+	d.findOwner()
+	return d, nil
+}
+
+// HasTray reports whether a system tray is currently running.
+func (d *Docker) HasTray() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.owner != 0
+}
+
+// findOwner looks up the tray selection owner and follows its destruction.
+func (d *Docker) findOwner() xproto.Window {
+	reply, err := xproto.GetSelectionOwner(d.Conn, d.Atoms.TraySelection).Reply()
+	owner := xproto.Window(0)
+	if err == nil && reply.Owner != xproto.WindowNone {
+		owner = reply.Owner
+		if err := xproto.ChangeWindowAttributesChecked(d.Conn, owner, xproto.CwEventMask, []uint32{xproto.EventMaskStructureNotify}).Check(); err != nil {
+			owner = 0
+		}
+	}
+	d.mu.Lock()
+	d.owner = owner
+	d.mu.Unlock()
+	if owner != 0 {
+		slog.Debug("found system tray", logging.Window(uint32(owner)))
+	}
+	return owner
+}
+
+// trayVisual returns the visual the tray asks icons to use, if it offers an
+// ARGB one.
+func (d *Docker) trayVisual(owner xproto.Window) (xproto.Visualid, byte, bool) {
+	if owner == 0 || d.Atoms.TrayVisual == 0 {
+		return 0, 0, false
+	}
+	reply, err := xproto.GetProperty(d.Conn, false, owner, d.Atoms.TrayVisual, xproto.AtomVisualid, 0, 1).Reply()
+	if err != nil || reply.Format != 32 || len(reply.Value) < 4 {
+		return 0, 0, false
+	}
+	visual := xproto.Visualid(xgb.Get32(reply.Value))
+	for _, depth := range d.screen.AllowedDepths {
+		for _, v := range depth.Visuals {
+			if v.VisualId == visual && depth.Depth == 32 {
+				return visual, depth.Depth, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// NewIcon creates a tray window titled title and docks it if a tray is
+// running; otherwise it is docked when one appears.
+func (d *Docker) NewIcon(title string) (*DockIcon, error) {
+	win, err := xproto.NewWindowId(d.Conn)
+	if err != nil {
+		return nil, fmt.Errorf("new window id: %w", err)
+	}
+	d.mu.Lock()
+	owner := d.owner
+	d.mu.Unlock()
+
+	eventMask := uint32(xproto.EventMaskExposure | xproto.EventMaskButtonPress | xproto.EventMaskStructureNotify)
+	depth := d.screen.RootDepth
+	if visual, vdepth, ok := d.trayVisual(owner); ok {
+		cmap, err := xproto.NewColormapId(d.Conn)
+		if err != nil {
+			return nil, fmt.Errorf("new colormap id: %w", err)
+		}
+		xproto.CreateColormap(d.Conn, xproto.ColormapAllocNone, cmap, d.Root, visual)
+		err = xproto.CreateWindowChecked(d.Conn, vdepth, win, d.Root, 0, 0, defaultDockSize, defaultDockSize, 0,
+			xproto.WindowClassInputOutput, visual,
+			xproto.CwBackPixel|xproto.CwBorderPixel|xproto.CwEventMask|xproto.CwColormap,
+			[]uint32{0, 0, eventMask, uint32(cmap)}).Check()
+		if err != nil {
+			return nil, fmt.Errorf("create window: %w", err)
+		}
+		depth = vdepth
+	} else {
+		// Without an ARGB visual the tray background shows through a
+		// ParentRelative background, and icons are blended over it.
+		err = xproto.CreateWindowChecked(d.Conn, depth, win, d.Root, 0, 0, defaultDockSize, defaultDockSize, 0,
+			xproto.WindowClassInputOutput, d.screen.RootVisual,
+			xproto.CwBackPixmap|xproto.CwEventMask,
+			[]uint32{xproto.BackPixmapParentRelative, eventMask}).Check()
+		if err != nil {
+			return nil, fmt.Errorf("create window: %w", err)
+		}
+	}
+
+	gc, err := xproto.NewGcontextId(d.Conn)
+	if err != nil {
+		xproto.DestroyWindow(d.Conn, win)
+		return nil, fmt.Errorf("new gc id: %w", err)
+	}
+	xproto.CreateGC(d.Conn, gc, xproto.Drawable(win), 0, nil)
+
+	icon := &DockIcon{
+		d:      d,
+		Window: win,
+		gc:     gc,
+		depth:  depth,
+		width:  defaultDockSize,
+		height: defaultDockSize,
+		log:    slog.With(logging.Window(uint32(win))),
+	}
+	icon.SetTitle(title)
+	xproto.ChangeProperty(d.Conn, xproto.PropModeReplace, win, xproto.AtomWmClass, xproto.AtomString, 8, uint32(len("xtrayhide\x00xtrayhide\x00")), []byte("xtrayhide\x00xtrayhide\x00"))
+	setXEmbedInfo(d.Conn, win, d.Atoms.XEmbedInfo)
+
+	d.mu.Lock()
+	d.icons[win] = icon
+	d.mu.Unlock()
+	if owner != 0 {
+		icon.dock(owner)
+	}
+	return icon, nil
+}
+
+// Run dispatches events for the docked windows until ctx is cancelled.
+func (d *Docker) Run(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		d.Conn.Close()
+	}()
+	for {
+		ev, err := d.Conn.WaitForEvent()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			slog.Debug("X error", "err", err)
+			continue
+		}
+		if ev == nil {
+			return fmt.Errorf("X connection closed")
+		}
+		switch e := ev.(type) {
+		case xproto.ExposeEvent:
+			if icon := d.icon(e.Window); icon != nil && e.Count == 0 {
+				icon.paint()
+			}
+		case xproto.ConfigureNotifyEvent:
+			if icon := d.icon(e.Window); icon != nil {
+				icon.resized(e.Width, e.Height)
+			}
+		case xproto.ButtonPressEvent:
+			if icon := d.icon(e.Event); icon != nil {
+				icon.clicked(byte(e.Detail), e.RootX, e.RootY)
+			}
+		case xproto.ReparentNotifyEvent:
+			// A tray that went away hands its icons back to the root
+			// window; keep them hidden until the next tray docks them.
+			if icon := d.icon(e.Window); icon != nil && e.Parent == d.Root {
+				xproto.UnmapWindow(d.Conn, icon.Window)
+			}
+		case xproto.DestroyNotifyEvent:
+			d.mu.Lock()
+			if e.Window == d.owner {
+				d.owner = 0
+				slog.Info("system tray went away")
+			}
+			d.mu.Unlock()
+		case xproto.ClientMessageEvent:
+			d.handleClientMessage(e)
+		}
+	}
+}
+
+// Close destroys all docked windows.
+func (d *Docker) Close() {
+	d.mu.Lock()
+	icons := make([]*DockIcon, 0, len(d.icons))
+	for _, icon := range d.icons {
+		icons = append(icons, icon)
+	}
+	d.mu.Unlock()
+	for _, icon := range icons {
+		icon.Close()
+	}
+	d.Conn.Sync()
+}
+
+func (d *Docker) handleClientMessage(ev xproto.ClientMessageEvent) {
+	if ev.Type != d.Atoms.Manager || ev.Format != 32 {
+		return
+	}
+	if xproto.Atom(ev.Data.Data32[1]) != d.Atoms.TraySelection {
+		return
+	}
+	owner := d.findOwner()
+	if owner == 0 {
+		return
+	}
+	slog.Info("system tray appeared, docking icons", logging.Window(uint32(owner)))
+	d.mu.Lock()
+	icons := make([]*DockIcon, 0, len(d.icons))
+	for _, icon := range d.icons {
+		icons = append(icons, icon)
+	}
+	d.mu.Unlock()
+	for _, icon := range icons {
+		icon.dock(owner)
+	}
+}
+
+func (d *Docker) icon(win xproto.Window) *DockIcon {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.icons[win]
+}
+
+// dock asks the tray owner to embed the icon.
+func (i *DockIcon) dock(owner xproto.Window) {
+	ev := xproto.ClientMessageEvent{
+		Format: 32,
+		Window: owner,
+		Type:   i.d.Atoms.TrayOpcode,
+		Data: xproto.ClientMessageDataUnionData32New([]uint32{
+			uint32(xproto.TimeCurrentTime),
+			systemTrayRequestDock,
+			uint32(i.Window),
+			0,
+			0,
+		}),
+	}
+	xproto.SendEvent(i.d.Conn, false, owner, xproto.EventMaskNoEvent, string(ev.Bytes()))
+	i.d.Conn.Sync()
+	i.log.Debug("requested dock", "tray", fmt.Sprintf("0x%x", owner))
+}
+
+// SetTitle names the window, which some trays show as a tooltip.
+func (i *DockIcon) SetTitle(title string) {
+	xproto.ChangeProperty(i.d.Conn, xproto.PropModeReplace, i.Window, i.d.Atoms.NetWMName, i.d.Atoms.UTF8String, 8, uint32(len(title)), []byte(title))
+	xproto.ChangeProperty(i.d.Conn, xproto.PropModeReplace, i.Window, xproto.AtomWmName, xproto.AtomString, 8, uint32(len(title)), []byte(title))
+}
+
+// SetImage replaces the painted image; it is scaled to the slot size given
+// by the tray.
+func (i *DockIcon) SetImage(img image.Image) {
+	i.mu.Lock()
+	i.img = img
+	i.mu.Unlock()
+	i.paint()
+}
+
+// SetClickHandler registers fn to be called from the event loop with the X
+// button and root coordinates of clicks on the icon.
+func (i *DockIcon) SetClickHandler(fn func(button uint8, x, y int16)) {
+	i.mu.Lock()
+	i.handler = fn
+	i.mu.Unlock()
+}
+
+// Close undocks and destroys the window.
+func (i *DockIcon) Close() {
+	i.d.mu.Lock()
+	delete(i.d.icons, i.Window)
+	i.d.mu.Unlock()
+	xproto.FreeGC(i.d.Conn, i.gc)
+	xproto.DestroyWindow(i.d.Conn, i.Window)
+}
+
+func (i *DockIcon) resized(width, height uint16) {
+	i.mu.Lock()
+	changed := width != i.width || height != i.height
+	i.width, i.height = width, height
+	i.mu.Unlock()
+	if changed {
+		i.paint()
+	}
+}
+
+func (i *DockIcon) clicked(button uint8, x, y int16) {
+	i.mu.Lock()
+	fn := i.handler
+	i.mu.Unlock()
+	if fn != nil {
+		fn(button, x, y)
+	}
+}
+
+func (i *DockIcon) paint() {
+	i.mu.Lock()
+	img, width, height := i.img, i.width, i.height
+	i.mu.Unlock()
+
+	xproto.ClearArea(i.d.Conn, false, i.Window, 0, 0, 0, 0)
+	if img == nil || width == 0 || height == 0 {
+		return
+	}
+	canvas := imaging.Fit(img, int(width), int(height))
+	if i.depth != 32 {
+		// Read back the ParentRelative background the clear just painted.
+		reply, err := xproto.GetImage(i.d.Conn, xproto.ImageFormatZPixmap, xproto.Drawable(i.Window), 0, 0, width, height, 0xffffffff).Reply()
+		if err != nil {
+			i.log.Debug("read background", "err", err)
+			return
+		}
+		bg, err := decodeZPixmap(i.d.Conn, reply.Data, width, height, reply.Depth)
+		if err != nil {
+			i.log.Debug("decode background", "err", err)
+			return
+		}
+		canvas = blendOver(bg, canvas)
+	}
+	xproto.PutImage(i.d.Conn, xproto.ImageFormatZPixmap, xproto.Drawable(i.Window), i.gc, width, height, 0, 0, 0, i.depth, encodeZPixmap(i.d.Conn, canvas, i.depth))
+}
@@ -0,0 +1,129 @@
+package tray
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/jezek/xgb/xproto"
+
+	"github.com/bnema/xtrayhide/internal/logging"
+)
+
+// Embedded identifies an icon hosted by a tray process, for handing it over
+// to its successor.
+type Embedded struct {
+	Window    xproto.Window
+	Container xproto.Window
+}
+
+// TakeOver becomes the tray in place of a running instance that retained its
+// icons (see Retain). The icons stay in their containers and are returned
+// instead of being sent as IconAdded events. trays are the manager windows of the
+// tray processes owning those containers; their resources are freed once the
+// icons are gone.
+func TakeOver(adopt []Embedded, trays []xproto.Window) (*Manager, []*Icon, error) {
+	return newManager(adopt, trays, true)
+}
+
+// Retain keeps the containers of icons alive after this process exits, so a
+// successor can adopt them: the close-down mode is set to RetainTemporary,
+// the icons leave the save set and their events are no longer selected. The
+// containers are no longer redirected either, which only one client may do.
+func (m *Manager) Retain(icons []*Icon) error {
+	for _, icon := range icons {
+		xproto.ChangeWindowAttributes(m.Conn, icon.Window, xproto.CwEventMask, []uint32{xproto.EventMaskNoEvent})
+		xproto.ChangeWindowAttributes(m.Conn, icon.Container, xproto.CwEventMask, []uint32{xproto.EventMaskNoEvent})
+		xproto.ChangeSaveSet(m.Conn, xproto.SetModeDelete, icon.Window)
+	}
+	if err := xproto.SetCloseDownModeChecked(m.Conn, xproto.CloseDownRetainTemporary).Check(); err != nil {
+		return fmt.Errorf("set close-down mode: %w", err)
+	}
+	m.retained.Store(true)
+	return nil
+}
+
+// Unretain undoes Retain when a handoff was aborted.
+func (m *Manager) Unretain(icons []*Icon) {
+	m.retained.Store(false)
+	xproto.SetCloseDownMode(m.Conn, xproto.CloseDownDestroyAll)
+	for _, icon := range icons {
+		xproto.ChangeWindowAttributes(m.Conn, icon.Window, xproto.CwEventMask, []uint32{iconEventMask})
+		xproto.ChangeWindowAttributes(m.Conn, icon.Container, xproto.CwEventMask, []uint32{containerEventMask})
+		xproto.ChangeSaveSet(m.Conn, xproto.SetModeInsert, icon.Window)
+	}
+	m.Conn.Sync()
+}
+
+// RetainedTrays returns the manager windows of the tray processes whose
+// containers the icons use, for the successor to pass to TakeOver: this one
+// and those it took over from whose icons are still docked.
+func (m *Manager) RetainedTrays() []xproto.Window {
+	m.adoptMu.Lock()
+	defer m.adoptMu.Unlock()
+	return append(slices.Clone(m.prevTrays), m.managerWin)
+}
+
+// releaseAdopted is called when an adopted icon is gone. The resources the
+// previous trays retained are freed with the last one.
+func (m *Manager) releaseAdopted() {
+	m.adoptMu.Lock()
+	m.adopted--
+	last := m.adopted == 0
+	m.adoptMu.Unlock()
+	if last {
+		m.killPrevious()
+	}
+}
+
+// killPrevious frees what the previous trays retained for this one. A
+// process that exited in RetainTemporary mode loses all its resources when
+// any of them is killed.
+func (m *Manager) killPrevious() {
+	m.adoptMu.Lock()
+	trays := m.prevTrays
+	m.prevTrays = nil
+	m.adoptMu.Unlock()
+	for _, win := range trays {
+		xproto.KillClient(m.Conn, uint32(win))
+		slog.Debug("freed previous tray", logging.Window(uint32(win)))
+	}
+}
+
+// adoptIcon takes over an icon window still embedded in the container of a
+// previous tray process.
+func (m *Manager) adoptIcon(e Embedded) (*Icon, error) {
+	tree, err := xproto.QueryTree(m.Conn, e.Window).Reply()
+	if err != nil {
+		return nil, fmt.Errorf("query tree: %w", err)
+	}
+	if tree.Parent != e.Container {
+		return nil, fmt.Errorf("icon is no longer in container 0x%x", e.Container)
+	}
+	attrs, err := xproto.GetWindowAttributes(m.Conn, e.Container).Reply()
+	if err != nil {
+		return nil, fmt.Errorf("get container attributes: %w", err)
+	}
+
+	if err := xproto.ChangeWindowAttributesChecked(m.Conn, e.Window, xproto.CwEventMask, []uint32{iconEventMask}).Check(); err != nil {
+		return nil, fmt.Errorf("select icon events: %w", err)
+	}
+	if err := xproto.ChangeWindowAttributesChecked(m.Conn, e.Container, xproto.CwEventMask, []uint32{containerEventMask &^ xproto.EventMaskSubstructureRedirect}).Check(); err != nil {
+		return nil, fmt.Errorf("select container events: %w", err)
+	}
+	if err := xproto.ChangeSaveSetChecked(m.Conn, xproto.SetModeInsert, e.Window).Check(); err != nil {
+		return nil, fmt.Errorf("change save set: %w", err)
+	}
+
+	icon := m.newIcon(e.Window, e.Container)
+	icon.mapped.Store(attrs.MapState != xproto.MapStateUnmapped)
+	icon.adopted = true
+	// Redirection fails while another client holds it; resize requests of
+	// the icon are then not followed.
+	if err := xproto.ChangeWindowAttributesChecked(m.Conn, e.Container, xproto.CwEventMask, []uint32{containerEventMask}).Check(); err != nil {
+		icon.log.Debug("redirect container failed", "err", err)
+	}
+	icon.initSize(defaultSlotSize)
+	icon.log.Debug("icon adopted", "container", fmt.Sprintf("0x%x", e.Container))
+	return icon, nil
+}
@@ -0,0 +1,82 @@
+package tray
+
+import (
+	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/xproto"
+)
+
+// WM_HINTS flags and field indexes (ICCCM 4.1.2.4).
+const (
+	hintWindowGroup = 1 << 6
+	hintUrgency     = 1 << 8
+
+	hintsFieldFlags       = 0
+	hintsFieldWindowGroup = 8
+	hintsFieldCount       = 9
+)
+
+// Leader returns the client leader window of the icon's application from
+// WM_CLIENT_LEADER or the WM_HINTS window group, or 0 when it has none.
+func (i *Icon) Leader() xproto.Window {
+	if leaders, err := getWindowListProperty(i.conn, i.Window, i.atoms.ClientLeader); err == nil && len(leaders) > 0 && leaders[0] != 0 {
+		return leaders[0]
+	}
+	hints, err := getWMHints(i.conn, i.Window)
+	if err == nil && hints != nil && hints[hintsFieldFlags]&hintWindowGroup != 0 {
+		return xproto.Window(hints[hintsFieldWindowGroup])
+	}
+	return 0
+}
+
+// Urgent reports whether the UrgencyHint is set on the icon window or on its
+// client leader.
+func (i *Icon) Urgent() bool {
+	for _, win := range []xproto.Window{i.Window, i.leader} {
+		if win == 0 {
+			continue
+		}
+		if hints, err := getWMHints(i.conn, win); err == nil && hints != nil && hints[hintsFieldFlags]&hintUrgency != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// SetUrgencyHandler registers fn to be called from the event loop when the
+// urgency state of the icon changes.
+func (i *Icon) SetUrgencyHandler(fn func(urgent bool)) {
+	i.mu.Lock()
+	i.urgencyHandler = fn
+	i.mu.Unlock()
+}
+
+func (i *Icon) handleHints() {
+	urgent := i.Urgent()
+	i.mu.Lock()
+	changed := urgent != i.urgent
+	i.urgent = urgent
+	fn := i.urgencyHandler
+	i.mu.Unlock()
+	if changed {
+		i.log.Debug("urgency hint changed", "urgent", urgent)
+	}
+	if changed && fn != nil {
+		fn(urgent)
+	}
+}
+
+// getWMHints returns the WM_HINTS fields of win, or nil when unset.
+func getWMHints(conn *xgb.Conn, win xproto.Window) ([]uint32, error) {
+	reply, err := xproto.GetProperty(conn, false, win, xproto.AtomWmHints, xproto.AtomWmHints, 0, hintsFieldCount).Reply()
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil || reply.Format != 32 || len(reply.Value) == 0 {
+		return nil, nil
+	}
+	hints := make([]uint32, hintsFieldCount)
+	for idx := 0; idx < hintsFieldCount && idx*4+4 <= len(reply.Value); idx++ {
+		hints[idx] = xgb.Get32(reply.Value[idx*4:])
+	}
+	return hints, nil
+}
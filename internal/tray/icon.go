@@ -2,52 +2,131 @@ package tray
 
 import (
 	"fmt"
+	"image"
+	"log/slog"
+	"sync"
+	"sync/atomic"
 
 	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/damage"
 	"github.com/jezek/xgb/xproto"
 )
 
 const (
-	xembedEmbeddedNotify = 0
-	xembedVersion        = 0
-	xembedMapped         = 1
+	xembedEmbeddedNotify   = 0
+	xembedWindowDeactivate = 2
+	xembedFocusOut         = 5
+	xembedVersion          = 0
+	xembedMapped           = 1
 )
 
 type Icon struct {
 	conn      *xgb.Conn
 	atoms     Atoms
+	root      xproto.Window
 	Window    xproto.Window
 	Container xproto.Window
-	mapped    bool
+	leader    xproto.Window
+	mapped    atomic.Bool
+	composite bool
+	xres      bool
+	xtest     bool
+	// adopted is set for icons taken over in the container of a previous
+	// tray process.
+	adopted bool
+	log     *slog.Logger
+
+	mu             sync.Mutex
+	popupHandler   func(*Popup)
+	titleHandler   func(string)
+	contentHandler func()
+
+	urgent         bool
+	urgencyHandler func(bool)
+
+	// captureMu serializes captures, and keeps Show, Hide and FakeClick
+	// from moving the icon in the middle of one.
+	captureMu sync.Mutex
+	damage    damage.Damage
+	// painted is signalled when the icon draws, capturing is set while it is
+	// mapped for a capture.
+	painted   chan struct{}
+	capturing atomic.Bool
+
+	sizeMu sync.Mutex
+	slot   uint16
+	policy SizePolicy
+	hints  sizeHints
+	// aspect is the width to height ratio last asked for by the client.
+	aspect        float64
+	width, height uint16
 }
 
 // Map makes the icon window visible (needed before capture).
 func (i *Icon) Map() {
-	if i.mapped {
+	if i.mapped.Load() {
 		return
 	}
 	xproto.MapWindow(i.conn, i.Container)
 	xproto.MapWindow(i.conn, i.Window)
 	i.conn.Sync()
-	i.mapped = true
+	i.mapped.Store(true)
 }
 
 // Unmap hides the icon window from display.
 func (i *Icon) Unmap() {
-	if !i.mapped {
+	if !i.mapped.Load() {
 		return
 	}
 	xproto.UnmapWindow(i.conn, i.Window)
 	xproto.UnmapWindow(i.conn, i.Container)
 	i.conn.Sync()
-	i.mapped = false
+	i.mapped.Store(false)
 }
 
 func (i *Icon) Capture() (width uint16, height uint16, data []byte, err error) {
+	width, height, _, data, err = i.capture()
+	return width, height, data, err
+}
+
+// CaptureImage captures the icon and decodes it into an image.
+func (i *Icon) CaptureImage() (*image.NRGBA, error) {
+	width, height, depth, data, err := i.capture()
+	if err != nil {
+		return nil, err
+	}
+	return decodeZPixmap(i.conn, data, width, height, depth)
+}
+
+// CaptureRaw captures the icon and returns the pixels as the X server sent
+// them along with the decoded image.
+func (i *Icon) CaptureRaw() (raw *image.NRGBA, img *image.NRGBA, err error) {
+	width, height, depth, data, err := i.capture()
+	if err != nil {
+		return nil, nil, err
+	}
+	img, err = decodeZPixmap(i.conn, data, width, height, depth)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rawImage(data, width, height), img, nil
+}
+
+func (i *Icon) capture() (width uint16, height uint16, depth byte, data []byte, err error) {
+	i.captureMu.Lock()
+	defer i.captureMu.Unlock()
+
 	// Temporarily map the window to capture its contents.
-	wasUnmapped := !i.mapped
+	wasUnmapped := !i.mapped.Load()
 	if wasUnmapped {
+		i.capturing.Store(true)
+		defer i.capturing.Store(false)
+		select {
+		case <-i.painted:
+		default:
+		}
 		i.Map()
+		i.waitPainted()
 	}
 
 	geom, err := xproto.GetGeometry(i.conn, xproto.Drawable(i.Window)).Reply()
@@ -55,7 +134,7 @@ func (i *Icon) Capture() (width uint16, height uint16, data []byte, err error) {
 		if wasUnmapped {
 			i.Unmap()
 		}
-		return 0, 0, nil, fmt.Errorf("get geometry: %w", err)
+		return 0, 0, 0, nil, fmt.Errorf("get geometry: %w", err)
 	}
 	width = geom.Width
 	height = geom.Height
@@ -65,7 +144,7 @@ func (i *Icon) Capture() (width uint16, height uint16, data []byte, err error) {
 		if wasUnmapped {
 			i.Unmap()
 		}
-		return 0, 0, nil, fmt.Errorf("get image: %w", err)
+		return 0, 0, 0, nil, fmt.Errorf("get image: %w", err)
 	}
 
 	// Unmap immediately after capture to keep it hidden.
@@ -73,26 +152,71 @@ func (i *Icon) Capture() (width uint16, height uint16, data []byte, err error) {
 		i.Unmap()
 	}
 
-	return width, height, img.Data, nil
+	return width, height, img.Depth, img.Data, nil
 }
 
 func (i *Icon) Title() string {
+	if title := i.WindowTitle(); title != "" {
+		return title
+	}
+	return fmt.Sprintf("xembed-%d", i.Window)
+}
+
+// WindowTitle returns the name set by the client on the icon window
+// (_NET_WM_NAME, WM_NAME, then WM_ICON_NAME), or "" when there is none.
+func (i *Icon) WindowTitle() string {
 	if title, err := getUTF8Property(i.conn, i.Window, i.atoms.NetWMName, i.atoms.UTF8String); err == nil && title != "" {
 		return title
 	}
 	if title, err := getStringProperty(i.conn, i.Window, i.atoms.WMName); err == nil && title != "" {
 		return title
 	}
-	return fmt.Sprintf("xembed-%d", i.Window)
+	if title, err := getStringProperty(i.conn, i.Window, xproto.AtomWmIconName); err == nil && title != "" {
+		return title
+	}
+	return ""
+}
+
+// SetTitleHandler registers fn to be called from the event loop with the new
+// window title whenever the client changes one of its name properties.
+func (i *Icon) SetTitleHandler(fn func(title string)) {
+	i.mu.Lock()
+	i.titleHandler = fn
+	i.mu.Unlock()
+}
+
+// Logger returns the logger carrying the icon's window attribute.
+func (i *Icon) Logger() *slog.Logger {
+	return i.log
+}
+
+func (i *Icon) handleProperty(atom xproto.Atom) {
+	switch atom {
+	case xproto.AtomWmHints:
+		i.handleHints()
+	case xproto.AtomWmNormalHints:
+		i.handleSizeHints()
+	case i.atoms.NetWMName, i.atoms.WMName, xproto.AtomWmIconName:
+		i.mu.Lock()
+		fn := i.titleHandler
+		i.mu.Unlock()
+		if fn != nil {
+			fn(i.WindowTitle())
+		}
+	}
 }
 
 func (i *Icon) sendXEmbedNotify() {
+	i.sendXEmbed(xembedEmbeddedNotify, 0, uint32(i.Container), xembedVersion)
+}
+
+func (i *Icon) sendXEmbed(message, detail, data1, data2 uint32) {
 	data := xproto.ClientMessageDataUnionData32New([]uint32{
 		uint32(xproto.TimeCurrentTime),
-		xembedEmbeddedNotify,
-		0,
-		uint32(i.Container),
-		xembedVersion,
+		message,
+		detail,
+		data1,
+		data2,
 	})
 	ev := xproto.ClientMessageEvent{
 		Format: 32,
@@ -104,12 +228,16 @@ func (i *Icon) sendXEmbedNotify() {
 }
 
 func (i *Icon) setXEmbedInfo() {
+	setXEmbedInfo(i.conn, i.Window, i.atoms.XEmbedInfo)
+}
+
+func setXEmbedInfo(conn *xgb.Conn, win xproto.Window, atom xproto.Atom) {
 	values := []uint32{xembedVersion, xembedMapped}
 	data := make([]byte, len(values)*4)
 	for idx, value := range values {
 		xgb.Put32(data[idx*4:], value)
 	}
-	xproto.ChangeProperty(i.conn, xproto.PropModeReplace, i.Window, i.atoms.XEmbedInfo, i.atoms.XEmbedInfo, 32, uint32(len(values)), data)
+	xproto.ChangeProperty(conn, xproto.PropModeReplace, win, atom, atom, 32, uint32(len(values)), data)
 }
 
 func getUTF8Property(conn *xgb.Conn, win xproto.Window, atom xproto.Atom, utf8Atom xproto.Atom) (string, error) {
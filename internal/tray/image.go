@@ -0,0 +1,103 @@
+package tray
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+
+	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/xproto"
+)
+
+// rawImage lays out GetImage ZPixmap data without decoding it: the four bytes
+// of each pixel become R, G, B and A in the order the server sent them, so
+// byte order and alpha problems stay visible.
+func rawImage(data []byte, width, height uint16) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, int(width), int(height)))
+	copy(img.Pix, data)
+	return img
+}
+
+// decodeZPixmap converts GetImage ZPixmap data into an NRGBA image. Only the
+// 32 bits per pixel layouts used by depth 24 and 32 visuals are supported.
+func decodeZPixmap(conn *xgb.Conn, data []byte, width, height uint16, depth byte) (*image.NRGBA, error) {
+	setup := xproto.Setup(conn)
+	bpp := byte(0)
+	for _, format := range setup.PixmapFormats {
+		if format.Depth == depth {
+			bpp = format.BitsPerPixel
+			break
+		}
+	}
+	if bpp != 32 {
+		return nil, fmt.Errorf("unsupported pixmap format: depth %d, %d bpp", depth, bpp)
+	}
+	stride := int(width) * 4
+	if len(data) < stride*int(height) {
+		return nil, fmt.Errorf("short image data: %d bytes for %dx%d", len(data), width, height)
+	}
+
+	lsbFirst := setup.ImageByteOrder == xproto.ImageOrderLSBFirst
+	img := image.NewNRGBA(image.Rect(0, 0, int(width), int(height)))
+	for y := 0; y < int(height); y++ {
+		for x := 0; x < int(width); x++ {
+			px := data[y*stride+x*4 : y*stride+x*4+4]
+			var c color.NRGBA
+			if lsbFirst {
+				c = color.NRGBA{R: px[2], G: px[1], B: px[0], A: px[3]}
+			} else {
+				c = color.NRGBA{R: px[1], G: px[2], B: px[3], A: px[0]}
+			}
+			if depth != 32 {
+				c.A = 0xff
+			} else if c.A != 0 {
+				// Depth 32 visuals carry premultiplied alpha.
+				c.R = uint8(min(int(c.R)*0xff/int(c.A), 0xff))
+				c.G = uint8(min(int(c.G)*0xff/int(c.A), 0xff))
+				c.B = uint8(min(int(c.B)*0xff/int(c.A), 0xff))
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img, nil
+}
+
+// encodeZPixmap converts img into PutImage ZPixmap data for a 32 bits per
+// pixel visual. Depth 32 gets premultiplied alpha; other depths ignore it.
+func encodeZPixmap(conn *xgb.Conn, img *image.NRGBA, depth byte) []byte {
+	lsbFirst := xproto.Setup(conn).ImageByteOrder == xproto.ImageOrderLSBFirst
+	b := img.Bounds()
+	data := make([]byte, 0, b.Dx()*b.Dy()*4)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.NRGBAAt(x, y)
+			if depth == 32 {
+				c.R = uint8(int(c.R) * int(c.A) / 0xff)
+				c.G = uint8(int(c.G) * int(c.A) / 0xff)
+				c.B = uint8(int(c.B) * int(c.A) / 0xff)
+			} else {
+				c.A = 0xff
+			}
+			if lsbFirst {
+				data = append(data, c.B, c.G, c.R, c.A)
+			} else {
+				data = append(data, c.A, c.R, c.G, c.B)
+			}
+		}
+	}
+	return data
+}
+
+// blendOver composites img over the opaque background bg of the same size.
+func blendOver(bg, img *image.NRGBA) *image.NRGBA {
+	out := image.NewNRGBA(img.Bounds())
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			fg, back := img.NRGBAAt(x, y), bg.NRGBAAt(x, y)
+			a := int(fg.A)
+			mix := func(f, b uint8) uint8 { return uint8((int(f)*a + int(b)*(0xff-a)) / 0xff) }
+			out.SetNRGBA(x, y, color.NRGBA{R: mix(fg.R, back.R), G: mix(fg.G, back.G), B: mix(fg.B, back.B), A: 0xff})
+		}
+	}
+	return out
+}
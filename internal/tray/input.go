@@ -0,0 +1,61 @@
+package tray
+
+import (
+	"fmt"
+
+	"github.com/jezek/xgb/xproto"
+	"github.com/jezek/xgb/xtest"
+)
+
+// FakeClick clicks the icon through the XTEST extension, for clients that
+// ignore synthetic events. The container is briefly moved under the pointer
+// so the server delivers the real event to the icon.
+func (i *Icon) FakeClick(button uint8) error {
+	if !i.xtest {
+		return fmt.Errorf("XTEST extension not available")
+	}
+	i.captureMu.Lock()
+	defer i.captureMu.Unlock()
+	pointer, err := xproto.QueryPointer(i.conn, i.root).Reply()
+	if err != nil {
+		return fmt.Errorf("query pointer: %w", err)
+	}
+	geom, err := xproto.GetGeometry(i.conn, xproto.Drawable(i.Container)).Reply()
+	if err != nil {
+		return fmt.Errorf("get geometry: %w", err)
+	}
+
+	x := int32(pointer.RootX) - int32(geom.Width)/2
+	y := int32(pointer.RootY) - int32(geom.Height)/2
+	xproto.ConfigureWindow(i.conn, i.Container, xproto.ConfigWindowX|xproto.ConfigWindowY|xproto.ConfigWindowStackMode, []uint32{uint32(x), uint32(y), xproto.StackModeAbove})
+	i.Map()
+
+	xtest.FakeInput(i.conn, xproto.ButtonPress, button, 0, i.root, 0, 0, 0)
+	xtest.FakeInput(i.conn, xproto.ButtonRelease, button, 0, i.root, 0, 0, 0)
+	i.conn.Sync()
+
+	i.hide()
+	return nil
+}
+
+// Show moves the container on screen at x, y and maps it, to inspect the real
+// icon window while debugging.
+func (i *Icon) Show(x, y int16) {
+	i.captureMu.Lock()
+	defer i.captureMu.Unlock()
+	xproto.ConfigureWindow(i.conn, i.Container, xproto.ConfigWindowX|xproto.ConfigWindowY|xproto.ConfigWindowStackMode, []uint32{uint32(int32(x)), uint32(int32(y)), xproto.StackModeAbove})
+	i.Map()
+}
+
+// Hide moves the container back off screen and unmaps it.
+func (i *Icon) Hide() {
+	i.captureMu.Lock()
+	defer i.captureMu.Unlock()
+	i.hide()
+}
+
+func (i *Icon) hide() {
+	offscreen := int32(containerOffscreen)
+	xproto.ConfigureWindow(i.conn, i.Container, xproto.ConfigWindowX|xproto.ConfigWindowY, []uint32{uint32(offscreen), uint32(offscreen)})
+	i.Unmap()
+}
@@ -3,36 +3,73 @@ package tray
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/composite"
+	"github.com/jezek/xgb/damage"
+	"github.com/jezek/xgb/res"
 	"github.com/jezek/xgb/xproto"
+	"github.com/jezek/xgb/xtest"
+
+	"github.com/bnema/xtrayhide/internal/logging"
 )
 
 const (
 	systemTrayRequestDock = 0
+	containerOffscreen    = -10000
+
+	containerEventMask = xproto.EventMaskStructureNotify | xproto.EventMaskExposure | xproto.EventMaskPropertyChange | xproto.EventMaskSubstructureRedirect
 )
 
 type Manager struct {
-	Conn        *xgb.Conn
-	Root        xproto.Window
-	RootVisual  xproto.Visualid
-	Atoms       Atoms
-	managerWin  xproto.Window
-	IconAdded   chan *Icon
-	IconRemoved chan *Icon
-	icons       map[xproto.Window]*Icon
+	Conn       *xgb.Conn
+	Root       xproto.Window
+	RootVisual xproto.Visualid
+	Atoms      Atoms
+	managerWin xproto.Window
+	events     *eventQueue
+	icons      map[xproto.Window]*Icon
+	leaders    map[xproto.Window][]*Icon
+	composite  bool
+	xres       bool
+	xtest      bool
+	damage     bool
+
+	pingMu sync.Mutex
+	pong   chan struct{}
+
+	// retained is set once the icons were retained for a successor.
+	retained atomic.Bool
+
+	// prevTrays are the manager windows of the trays icons were adopted
+	// from, adopted how many of those icons are still docked.
+	adoptMu   sync.Mutex
+	prevTrays []xproto.Window
+	adopted   int
 }
 
 func NewManager() (*Manager, error) {
+	m, _, err := newManager(nil, nil, false)
+	return m, err
+}
+
+// newManager connects to X and becomes the tray. The icons in adopt are
+// taken over from the trays before the selection is acquired; replace allows
+// taking the selection from a running tray.
+func newManager(adopt []Embedded, trays []xproto.Window, replace bool) (*Manager, []*Icon, error) {
 	conn, err := xgb.NewConn()
 	if err != nil {
-		return nil, fmt.Errorf("connect X11: %w", err)
+		return nil, nil, fmt.Errorf("connect X11: %w", err)
 	}
 
 	atoms, err := InternAtoms(conn)
 	if err != nil {
 		conn.Close()
-		return nil, err
+		return nil, nil, err
 	}
 
 	setup := xproto.Setup(conn)
@@ -43,17 +80,17 @@ func NewManager() (*Manager, error) {
 	ownerReply, err := xproto.GetSelectionOwner(conn, atoms.TraySelection).Reply()
 	if err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("get selection owner: %w", err)
+		return nil, nil, fmt.Errorf("get selection owner: %w", err)
 	}
-	if ownerReply.Owner != xproto.WindowNone {
+	if ownerReply.Owner != xproto.WindowNone && !replace {
 		conn.Close()
-		return nil, fmt.Errorf("system tray already owned by window %d", ownerReply.Owner)
+		return nil, nil, fmt.Errorf("system tray already owned by window %d", ownerReply.Owner)
 	}
 
 	managerWin, err := xproto.NewWindowId(conn)
 	if err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("new window id: %w", err)
+		return nil, nil, fmt.Errorf("new window id: %w", err)
 	}
 
 	err = xproto.CreateWindowChecked(
@@ -70,56 +107,104 @@ func NewManager() (*Manager, error) {
 	).Check()
 	if err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("create manager window: %w", err)
+		return nil, nil, fmt.Errorf("create manager window: %w", err)
+	}
+
+	m := &Manager{
+		Conn:       conn,
+		Root:       root,
+		RootVisual: rootVisual,
+		Atoms:      atoms,
+		managerWin: managerWin,
+		events:     newEventQueue(),
+		icons:      make(map[xproto.Window]*Icon),
+		leaders:    make(map[xproto.Window][]*Icon),
+		composite:  composite.Init(conn) == nil,
+		xres:       res.Init(conn) == nil,
+		xtest:      xtest.Init(conn) == nil,
+		damage:     initDamage(conn),
+		pong:       make(chan struct{}, 1),
+		prevTrays:  trays,
 	}
 
+	var adopted []*Icon
+	for _, e := range adopt {
+		icon, err := m.adoptIcon(e)
+		if err != nil {
+			slog.Warn("adopt icon failed", logging.Window(uint32(e.Window)), "err", err)
+			continue
+		}
+		m.icons[icon.Window] = icon
+		m.watchLeader(icon)
+		icon.urgent = icon.Urgent()
+		adopted = append(adopted, icon)
+	}
+	m.adopted = len(adopted)
+
 	if err := xproto.SetSelectionOwnerChecked(conn, managerWin, atoms.TraySelection, xproto.TimeCurrentTime).Check(); err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("set selection owner: %w", err)
+		return nil, nil, fmt.Errorf("set selection owner: %w", err)
 	}
 
 	if err := broadcastManager(conn, root, atoms.Manager, atoms.TraySelection, managerWin); err != nil {
 		conn.Close()
-		return nil, err
+		return nil, nil, err
 	}
 
-	m := &Manager{
-		Conn:        conn,
-		Root:        root,
-		RootVisual:  rootVisual,
-		Atoms:       atoms,
-		managerWin:  managerWin,
-		IconAdded:   make(chan *Icon, 16),
-		IconRemoved: make(chan *Icon, 16),
-		icons:       make(map[xproto.Window]*Icon),
+	// Watch top-level windows so popup menus opened by docked clients can be
+	// intercepted.
+	if err := xproto.ChangeWindowAttributesChecked(conn, root, xproto.CwEventMask, []uint32{xproto.EventMaskSubstructureNotify}).Check(); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("select root events: %w", err)
 	}
 
-	return m, nil
+	slog.Debug("tray manager ready", logging.Window(uint32(managerWin)),
+		"composite", m.composite, "xres", m.xres, "xtest", m.xtest, "damage", m.damage)
+
+	return m, adopted, nil
 }
 
+// Events delivers icons docking and going away. The channel is closed
+// after Run returned and the pending events were received.
+func (m *Manager) Events() <-chan Event {
+	return m.events.out
+}
+
+// Run dispatches X events until ctx is cancelled, then releases the icons
+// and the tray selection and closes the connection. It returns nil after
+// such an orderly shutdown.
 func (m *Manager) Run(ctx context.Context) error {
+	defer m.events.close()
+	defer m.Conn.Close()
 	go func() {
 		<-ctx.Done()
-		m.Conn.Close()
+		// Wake up WaitForEvent with a PropertyNotify on the manager window.
+		xproto.ChangeProperty(m.Conn, xproto.PropModeReplace, m.managerWin, xproto.AtomWmName, xproto.AtomString, 8, 0, nil)
 	}()
 
 	for {
 		ev, err := m.Conn.WaitForEvent()
+		if ctx.Err() != nil {
+			m.shutdown()
+			return nil
+		}
 		if err != nil {
-			if ctx.Err() != nil {
-				return ctx.Err()
-			}
-			return fmt.Errorf("wait for event: %w", err)
+			// Errors from unchecked requests, typically on windows that
+			// were destroyed meanwhile.
+			slog.Debug("X error", "err", err)
+			continue
 		}
 		if ev == nil {
-			continue
+			return fmt.Errorf("X connection closed")
 		}
-		switch e := ev.(type) {
-		case xproto.ClientMessageEvent:
-			m.handleClientMessage(e)
-		case xproto.DestroyNotifyEvent:
-			m.handleDestroy(e)
+		if e, ok := ev.(xproto.SelectionClearEvent); ok && e.Selection == m.Atoms.TraySelection {
+			m.shutdown()
+			if m.retained.Load() {
+				return nil
+			}
+			return fmt.Errorf("tray selection taken by another client")
 		}
+		m.dispatch(ev)
 	}
 }
 
@@ -135,12 +220,23 @@ func (m *Manager) handleClientMessage(ev xproto.ClientMessageEvent) {
 		return
 	}
 	iconWin := xproto.Window(data[2])
+	if icon, ok := m.icons[iconWin]; ok {
+		// Clients re-dock when the tray they knew went away, including
+		// icons adopted from a previous instance.
+		icon.log.Debug("icon docked again")
+		icon.sendXEmbedNotify()
+		return
+	}
 	icon, err := m.embedIcon(iconWin)
 	if err != nil {
+		slog.Warn("embed icon failed", logging.Window(uint32(iconWin)), "err", err)
 		return
 	}
+	icon.log.Debug("icon embedded", "container", fmt.Sprintf("0x%x", icon.Container))
 	m.icons[iconWin] = icon
-	m.IconAdded <- icon
+	m.watchLeader(icon)
+	icon.urgent = icon.Urgent()
+	m.events.push(Event{Kind: IconAdded, Icon: icon})
 }
 
 func (m *Manager) handleDestroy(ev xproto.DestroyNotifyEvent) {
@@ -148,8 +244,102 @@ func (m *Manager) handleDestroy(ev xproto.DestroyNotifyEvent) {
 	if !ok {
 		return
 	}
-	delete(m.icons, ev.Window)
-	m.IconRemoved <- icon
+	icon.log.Debug("icon window destroyed")
+	if icon.adopted {
+		// The container belongs to the previous tray, which no longer
+		// cleans it up.
+		xproto.DestroyWindow(m.Conn, icon.Container)
+	}
+	m.removeIcon(icon)
+}
+
+func (m *Manager) removeIcon(icon *Icon) {
+	delete(m.icons, icon.Window)
+	m.unwatchLeader(icon)
+	if icon.adopted {
+		m.releaseAdopted()
+	}
+	m.events.push(Event{Kind: IconRemoved, Icon: icon})
+}
+
+func (m *Manager) handleProperty(ev xproto.PropertyNotifyEvent) {
+	if ev.Window == m.managerWin {
+		select {
+		case m.pong <- struct{}{}:
+		default:
+		}
+		return
+	}
+	if icon, ok := m.icons[ev.Window]; ok {
+		icon.handleProperty(ev.Atom)
+	}
+	if ev.Atom == xproto.AtomWmHints {
+		for _, icon := range m.leaders[ev.Window] {
+			icon.handleHints()
+		}
+	}
+}
+
+// Ping checks that Run is still processing events: it touches a property
+// on the manager window and waits for the resulting PropertyNotify to be
+// dispatched.
+func (m *Manager) Ping(timeout time.Duration) error {
+	m.pingMu.Lock()
+	defer m.pingMu.Unlock()
+	select {
+	case <-m.pong:
+	default:
+	}
+	xproto.ChangeProperty(m.Conn, xproto.PropModeReplace, m.managerWin, xproto.AtomWmName, xproto.AtomString, 8, 0, nil)
+	select {
+	case <-m.pong:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("event loop did not respond within %v", timeout)
+	}
+}
+
+// watchLeader follows WM_HINTS changes on the icon's client leader, where
+// many applications set the urgency hint.
+func (m *Manager) watchLeader(icon *Icon) {
+	leader := icon.Leader()
+	if leader == 0 || leader == icon.Window {
+		return
+	}
+	if _, watched := m.leaders[leader]; !watched {
+		if err := xproto.ChangeWindowAttributesChecked(m.Conn, leader, xproto.CwEventMask, []uint32{xproto.EventMaskPropertyChange}).Check(); err != nil {
+			icon.log.Debug("watch client leader failed", "leader", fmt.Sprintf("0x%x", leader), "err", err)
+			return
+		}
+	}
+	icon.leader = leader
+	m.leaders[leader] = append(m.leaders[leader], icon)
+}
+
+func (m *Manager) unwatchLeader(icon *Icon) {
+	icons := m.leaders[icon.leader]
+	for idx, other := range icons {
+		if other == icon {
+			icons = append(icons[:idx], icons[idx+1:]...)
+			break
+		}
+	}
+	if len(icons) == 0 {
+		delete(m.leaders, icon.leader)
+		return
+	}
+	m.leaders[icon.leader] = icons
+}
+
+func (m *Manager) handleMap(ev xproto.MapNotifyEvent) {
+	if !ev.OverrideRedirect || ev.Event != m.Root {
+		return
+	}
+	for _, icon := range m.icons {
+		if icon.handlePopup(ev.Window) {
+			return
+		}
+	}
 }
 
 func (m *Manager) embedIcon(iconWin xproto.Window) (*Icon, error) {
@@ -158,22 +348,18 @@ func (m *Manager) embedIcon(iconWin xproto.Window) (*Icon, error) {
 		return nil, fmt.Errorf("new container id: %w", err)
 	}
 
-	// Tray icons sometimes report (or start with) very large window geometries.
-	// Keep an explicit, small slot size and force the icon window to it.
-	width := uint16(32)
-	height := uint16(32)
-
 	err = xproto.CreateWindowChecked(
 		m.Conn,
 		0,
 		container,
 		m.Root,
-		-10000, -10000, width, height,
+		containerOffscreen, containerOffscreen, defaultSlotSize, defaultSlotSize,
 		0,
 		xproto.WindowClassInputOutput,
 		m.RootVisual,
 		xproto.CwEventMask,
-		[]uint32{xproto.EventMaskStructureNotify | xproto.EventMaskExposure | xproto.EventMaskPropertyChange},
+		// Resize requests of the icon window are redirected to us.
+		[]uint32{containerEventMask},
 	).Check()
 	if err != nil {
 		return nil, fmt.Errorf("create container: %w", err)
@@ -188,12 +374,7 @@ func (m *Manager) embedIcon(iconWin xproto.Window) (*Icon, error) {
 		return nil, fmt.Errorf("reparent icon: %w", err)
 	}
 
-	// Force a sane size for capture and to avoid huge toplevel windows.
-	if err := xproto.ConfigureWindowChecked(m.Conn, iconWin, xproto.ConfigWindowWidth|xproto.ConfigWindowHeight, []uint32{uint32(width), uint32(height)}).Check(); err != nil {
-		return nil, fmt.Errorf("resize icon: %w", err)
-	}
-
-	if err := xproto.ChangeWindowAttributesChecked(m.Conn, iconWin, xproto.CwEventMask, []uint32{xproto.EventMaskStructureNotify | xproto.EventMaskPropertyChange}).Check(); err != nil {
+	if err := xproto.ChangeWindowAttributesChecked(m.Conn, iconWin, xproto.CwEventMask, []uint32{iconEventMask}).Check(); err != nil {
 		return nil, fmt.Errorf("select icon events: %w", err)
 	}
 
@@ -204,11 +385,12 @@ func (m *Manager) embedIcon(iconWin xproto.Window) (*Icon, error) {
 	// Do NOT map the windows - keep them hidden from Wayland/XWayland.
 	// The icon will be temporarily mapped only when capturing the pixmap.
 
-	icon := &Icon{
-		conn:      m.Conn,
-		atoms:     m.Atoms,
-		Window:    iconWin,
-		Container: container,
+	icon := m.newIcon(iconWin, container)
+	// Tray icons sometimes report (or start with) very large window
+	// geometries; only their aspect ratio is kept.
+	icon.initSize(defaultSlotSize)
+	if err := icon.applySize(); err != nil {
+		return nil, err
 	}
 	icon.setXEmbedInfo()
 	icon.sendXEmbedNotify()
@@ -216,6 +398,16 @@ func (m *Manager) embedIcon(iconWin xproto.Window) (*Icon, error) {
 	return icon, nil
 }
 
+// initDamage enables the Damage extension, which requires announcing the
+// supported version first.
+func initDamage(conn *xgb.Conn) bool {
+	if damage.Init(conn) != nil {
+		return false
+	}
+	_, err := damage.QueryVersion(conn, 1, 1).Reply()
+	return err == nil
+}
+
 func broadcastManager(conn *xgb.Conn, root xproto.Window, managerAtom xproto.Atom, trayAtom xproto.Atom, managerWin xproto.Window) error {
 	ev := xproto.ClientMessageEvent{
 		Format: 32,
@@ -0,0 +1,176 @@
+package tray
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/composite"
+	"github.com/jezek/xgb/xproto"
+)
+
+const (
+	keysymEscape   = 0xff1b
+	keycodeEscape  = 9
+	popupOffscreen = -10000
+)
+
+// Popup is an override-redirect window (usually a context menu) opened by the
+// client owning a docked icon.
+type Popup struct {
+	conn      *xgb.Conn
+	root      xproto.Window
+	composite bool
+	Window    xproto.Window
+	Width     uint16
+	Height    uint16
+}
+
+// SetPopupHandler registers fn to be called from the event loop whenever the
+// icon's client maps an override-redirect window. fn must not block.
+func (i *Icon) SetPopupHandler(fn func(*Popup)) {
+	i.mu.Lock()
+	i.popupHandler = fn
+	i.mu.Unlock()
+}
+
+func (i *Icon) handlePopup(win xproto.Window) bool {
+	if !i.sameClient(win) {
+		return false
+	}
+	i.mu.Lock()
+	fn := i.popupHandler
+	i.mu.Unlock()
+	if fn == nil {
+		return false
+	}
+	geom, err := xproto.GetGeometry(i.conn, xproto.Drawable(win)).Reply()
+	if err != nil {
+		i.log.Debug("popup geometry", "popup", fmt.Sprintf("0x%x", win), "err", err)
+		return false
+	}
+	i.log.Debug("client popup mapped", "popup", fmt.Sprintf("0x%x", win), "width", geom.Width, "height", geom.Height)
+	fn(&Popup{
+		conn:      i.conn,
+		root:      i.root,
+		composite: i.composite,
+		Window:    win,
+		Width:     geom.Width,
+		Height:    geom.Height,
+	})
+	return true
+}
+
+// Hide moves the popup off screen while keeping it mapped, so it still
+// renders and accepts input.
+func (p *Popup) Hide() error {
+	offscreen := int32(popupOffscreen)
+	err := xproto.ConfigureWindowChecked(p.conn, p.Window, xproto.ConfigWindowX|xproto.ConfigWindowY, []uint32{uint32(offscreen), uint32(offscreen)}).Check()
+	if err != nil {
+		return fmt.Errorf("move popup: %w", err)
+	}
+	if p.composite {
+		composite.RedirectWindow(p.conn, p.Window, composite.RedirectAutomatic)
+	}
+	// Ask the client to repaint now that its contents are redirected.
+	xproto.ClearArea(p.conn, true, p.Window, 0, 0, 0, 0)
+	p.conn.Sync()
+	return nil
+}
+
+// Capture returns the current contents of the popup.
+func (p *Popup) Capture() (*image.NRGBA, error) {
+	geom, err := xproto.GetGeometry(p.conn, xproto.Drawable(p.Window)).Reply()
+	if err != nil {
+		return nil, fmt.Errorf("get geometry: %w", err)
+	}
+	p.Width = geom.Width
+	p.Height = geom.Height
+
+	drawable := xproto.Drawable(p.Window)
+	if p.composite {
+		pixmap, err := xproto.NewPixmapId(p.conn)
+		if err != nil {
+			return nil, fmt.Errorf("new pixmap id: %w", err)
+		}
+		if err := composite.NameWindowPixmapChecked(p.conn, p.Window, pixmap).Check(); err == nil {
+			defer xproto.FreePixmap(p.conn, pixmap)
+			drawable = xproto.Drawable(pixmap)
+		}
+	}
+
+	img, err := xproto.GetImage(p.conn, xproto.ImageFormatZPixmap, drawable, 0, 0, geom.Width, geom.Height, 0xffffffff).Reply()
+	if err != nil {
+		return nil, fmt.Errorf("get image: %w", err)
+	}
+	return decodeZPixmap(p.conn, img.Data, geom.Width, geom.Height, img.Depth)
+}
+
+// Click sends a pointer motion and a button 1 click at x, y (popup coordinates).
+func (p *Popup) Click(x, y int16) {
+	motion := xproto.MotionNotifyEvent{
+		Detail:     xproto.MotionNormal,
+		Time:       xproto.TimeCurrentTime,
+		Root:       p.root,
+		Event:      p.Window,
+		RootX:      popupOffscreen + x,
+		RootY:      popupOffscreen + y,
+		EventX:     x,
+		EventY:     y,
+		SameScreen: true,
+	}
+	press := xproto.ButtonPressEvent{
+		Detail:     xproto.ButtonIndex1,
+		Time:       xproto.TimeCurrentTime,
+		Root:       p.root,
+		Event:      p.Window,
+		RootX:      popupOffscreen + x,
+		RootY:      popupOffscreen + y,
+		EventX:     x,
+		EventY:     y,
+		SameScreen: true,
+	}
+	release := xproto.ButtonReleaseEvent(press)
+	release.State = xproto.KeyButMaskButton1
+
+	xproto.SendEvent(p.conn, false, p.Window, xproto.EventMaskPointerMotion, string(motion.Bytes()))
+	xproto.SendEvent(p.conn, false, p.Window, xproto.EventMaskButtonPress, string(press.Bytes()))
+	xproto.SendEvent(p.conn, false, p.Window, xproto.EventMaskButtonRelease, string(release.Bytes()))
+	p.conn.Sync()
+}
+
+// Dismiss closes the popup the way a user would, by pressing Escape.
+func (p *Popup) Dismiss() {
+	press := xproto.KeyPressEvent{
+		Detail:     keycodeFor(p.conn, keysymEscape, keycodeEscape),
+		Time:       xproto.TimeCurrentTime,
+		Root:       p.root,
+		Event:      p.Window,
+		SameScreen: true,
+	}
+	release := xproto.KeyReleaseEvent(press)
+	xproto.SendEvent(p.conn, false, p.Window, xproto.EventMaskKeyPress, string(press.Bytes()))
+	xproto.SendEvent(p.conn, false, p.Window, xproto.EventMaskKeyRelease, string(release.Bytes()))
+	p.conn.Sync()
+}
+
+// keycodeFor looks up the first keycode producing keysym, or returns fallback.
+func keycodeFor(conn *xgb.Conn, keysym xproto.Keysym, fallback xproto.Keycode) xproto.Keycode {
+	setup := xproto.Setup(conn)
+	count := byte(setup.MaxKeycode - setup.MinKeycode + 1)
+	reply, err := xproto.GetKeyboardMapping(conn, setup.MinKeycode, count).Reply()
+	if err != nil || reply.KeysymsPerKeycode == 0 {
+		return fallback
+	}
+	perKeycode := int(reply.KeysymsPerKeycode)
+	for idx, sym := range reply.Keysyms {
+		code := int(setup.MinKeycode) + idx/perKeycode
+		if code > int(setup.MaxKeycode) {
+			break
+		}
+		if sym == keysym {
+			return xproto.Keycode(code)
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,80 @@
+package tray
+
+import "sync"
+
+type EventKind int
+
+const (
+	IconAdded EventKind = iota
+	IconRemoved
+)
+
+// Event reports an icon docking or going away. Events are delivered in the
+// order they happened, so an icon's removal always follows its addition.
+type Event struct {
+	Kind EventKind
+	Icon *Icon
+}
+
+// eventQueue delivers events on a channel without ever blocking the sender:
+// events the receiver has not taken yet are buffered without limit.
+type eventQueue struct {
+	out  chan Event
+	wake chan struct{}
+
+	mu     sync.Mutex
+	items  []Event
+	closed bool
+}
+
+func newEventQueue() *eventQueue {
+	q := &eventQueue{
+		out:  make(chan Event),
+		wake: make(chan struct{}, 1),
+	}
+	go q.run()
+	return q
+}
+
+func (q *eventQueue) push(ev Event) {
+	q.mu.Lock()
+	q.items = append(q.items, ev)
+	q.mu.Unlock()
+	q.signal()
+}
+
+// close closes the channel once the pending events were received.
+func (q *eventQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.signal()
+}
+
+func (q *eventQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *eventQueue) run() {
+	for {
+		q.mu.Lock()
+		if len(q.items) == 0 {
+			closed := q.closed
+			q.mu.Unlock()
+			if closed {
+				close(q.out)
+				return
+			}
+			<-q.wake
+			continue
+		}
+		ev := q.items[0]
+		q.items[0] = Event{}
+		q.items = q.items[1:]
+		q.mu.Unlock()
+		q.out <- ev
+	}
+}
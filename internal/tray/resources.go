@@ -0,0 +1,35 @@
+package tray
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+
+	"github.com/jezek/xgb/xproto"
+)
+
+// Xft.dpi at a scale factor of 1.
+const baseDPI = 96
+
+// ScaleFactor returns the UI scale set through Xft.dpi in the
+// RESOURCE_MANAGER property of the root window, as xrdb and most desktop
+// settings daemons do for HiDPI outputs. It is 1 when no DPI is set.
+func (m *Manager) ScaleFactor() float64 {
+	reply, err := xproto.GetProperty(m.Conn, false, m.Root, xproto.AtomResourceManager, xproto.AtomString, 0, 1<<16).Reply()
+	if err != nil || reply.Format != 8 {
+		return 1
+	}
+	scanner := bufio.NewScanner(strings.NewReader(string(reply.Value)))
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || strings.TrimSpace(name) != "Xft.dpi" {
+			continue
+		}
+		dpi, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || dpi <= baseDPI {
+			return 1
+		}
+		return dpi / baseDPI
+	}
+	return 1
+}
@@ -0,0 +1,48 @@
+package tray
+
+import (
+	"log/slog"
+
+	"github.com/jezek/xgb/damage"
+	"github.com/jezek/xgb/xproto"
+)
+
+// shutdown hands every icon back to the root window and gives up the tray
+// selection, so the next tray owner gets clean dock requests instead of
+// windows restored by the save set. Retained icons are left in place for the
+// successor, along with the manager window it frees them through.
+func (m *Manager) shutdown() {
+	if m.retained.Load() {
+		slog.Info("leaving icons to the next tray", "icons", len(m.icons))
+		m.Conn.Sync()
+		return
+	}
+	slog.Info("releasing tray", "icons", len(m.icons))
+	for win, icon := range m.icons {
+		icon.unembed()
+		delete(m.icons, win)
+	}
+	m.leaders = make(map[xproto.Window][]*Icon)
+	m.killPrevious()
+
+	xproto.SetSelectionOwner(m.Conn, xproto.WindowNone, m.Atoms.TraySelection, xproto.TimeCurrentTime)
+	xproto.DestroyWindow(m.Conn, m.managerWin)
+	m.Conn.Sync()
+}
+
+// unembed reparents the icon window to the root, unmapped, and destroys its
+// container.
+func (i *Icon) unembed() {
+	xproto.ChangeWindowAttributes(i.conn, i.Window, xproto.CwEventMask, []uint32{xproto.EventMaskNoEvent})
+	i.sendXEmbed(xembedFocusOut, 0, 0, 0)
+	i.sendXEmbed(xembedWindowDeactivate, 0, 0, 0)
+	xproto.UnmapWindow(i.conn, i.Window)
+	xproto.ReparentWindow(i.conn, i.Window, i.root, 0, 0)
+	xproto.ChangeSaveSet(i.conn, xproto.SetModeDelete, i.Window)
+	xproto.DestroyWindow(i.conn, i.Container)
+	if i.damage != 0 {
+		damage.Destroy(i.conn, i.damage)
+	}
+	i.mapped.Store(false)
+	i.log.Debug("icon released to root window")
+}
@@ -0,0 +1,239 @@
+package tray
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/xproto"
+
+	"github.com/bnema/xtrayhide/internal/config"
+)
+
+// WM_SIZE_HINTS flags and field indexes (ICCCM 4.1.2.3).
+const (
+	sizeHintMinSize = 1 << 4
+	sizeHintMaxSize = 1 << 5
+	sizeHintAspect  = 1 << 7
+
+	sizeFieldFlags     = 0
+	sizeFieldMinWidth  = 5
+	sizeFieldMinHeight = 6
+	sizeFieldMaxWidth  = 7
+	sizeFieldMaxHeight = 8
+	sizeFieldMinAspect = 11
+	sizeFieldMaxAspect = 13
+	sizeFieldCount     = 18
+)
+
+const (
+	defaultSlotSize = 32
+	// Icons are at most maxAspect times wider than high, or higher than
+	// wide.
+	maxAspect = 4
+	// Requests for sizes below minRequest pixels, such as the 1x1 some
+	// clients ask for while reconfiguring, are ignored.
+	minRequest = 4
+)
+
+// SizePolicy controls how an icon follows the size its client asks for.
+type SizePolicy struct {
+	// Fixed keeps the icon square at the slot size, ignoring requests and
+	// WM_NORMAL_HINTS.
+	Fixed bool
+	// Aspect, when positive, forces the width to height ratio.
+	Aspect float64
+}
+
+type sizeHints struct {
+	minWidth, minHeight int
+	maxWidth, maxHeight int
+	// aspect is set when the client asks for a single ratio.
+	aspect float64
+}
+
+// SetSize changes the slot of the icon: it is slot pixels high and as wide
+// as its client and policy want. The container follows the icon.
+func (i *Icon) SetSize(slot uint16, policy SizePolicy) error {
+	i.sizeMu.Lock()
+	i.slot = slot
+	i.policy = policy
+	i.sizeMu.Unlock()
+	return i.applySize()
+}
+
+// Size returns the current size of the icon window.
+func (i *Icon) Size() (width, height uint16) {
+	i.sizeMu.Lock()
+	defer i.sizeMu.Unlock()
+	return i.width, i.height
+}
+
+// initSize sets up the size state of a newly docked icon from its current
+// geometry and size hints.
+func (i *Icon) initSize(slot uint16) {
+	i.slot = slot
+	i.aspect = 1
+	if geom, err := xproto.GetGeometry(i.conn, xproto.Drawable(i.Window)).Reply(); err == nil {
+		i.width, i.height = geom.Width, geom.Height
+		i.requestSize(geom.Width, geom.Height)
+	}
+	i.hints = getSizeHints(i.conn, i.Window)
+}
+
+// requestSize records the aspect ratio of a size wanted by the client. The
+// caller holds sizeMu.
+func (i *Icon) requestSize(width, height uint16) {
+	if width < minRequest || height < minRequest {
+		i.log.Debug("ignoring icon size request", "width", width, "height", height)
+		return
+	}
+	i.aspect = float64(width) / float64(height)
+}
+
+// layout returns the icon size for the slot. The caller holds sizeMu.
+func (i *Icon) layout() (uint16, uint16) {
+	slot := i.slot
+	if slot == 0 {
+		slot = defaultSlotSize
+	}
+	if i.policy.Fixed {
+		return slot, slot
+	}
+	aspect := i.aspect
+	switch {
+	case i.policy.Aspect > 0:
+		aspect = i.policy.Aspect
+	case i.hints.aspect > 0:
+		aspect = i.hints.aspect
+	}
+	aspect = min(max(aspect, 1.0/maxAspect), maxAspect)
+
+	// Like panels, keep the slot height and adapt the width.
+	width, height := i.hints.constrain(int(math.Round(float64(slot)*aspect)), int(slot))
+	return uint16(max(1, width)), uint16(max(1, height))
+}
+
+// applySize resizes the icon and its container to the current layout.
+func (i *Icon) applySize() error {
+	i.sizeMu.Lock()
+	width, height := i.layout()
+	changed := width != i.width || height != i.height
+	i.width, i.height = width, height
+	i.sizeMu.Unlock()
+	if changed {
+		i.log.Debug("icon resized", "width", width, "height", height)
+	}
+
+	values := []uint32{uint32(width), uint32(height)}
+	if err := xproto.ConfigureWindowChecked(i.conn, i.Container, xproto.ConfigWindowWidth|xproto.ConfigWindowHeight, values).Check(); err != nil {
+		return fmt.Errorf("resize container: %w", err)
+	}
+	if err := xproto.ConfigureWindowChecked(i.conn, i.Window, xproto.ConfigWindowX|xproto.ConfigWindowY|xproto.ConfigWindowWidth|xproto.ConfigWindowHeight, []uint32{0, 0, uint32(width), uint32(height)}).Check(); err != nil {
+		return fmt.Errorf("resize icon: %w", err)
+	}
+	return nil
+}
+
+// handleConfigureRequest runs on the event loop when the client tries to
+// resize its icon window, which the container redirects to us.
+func (i *Icon) handleConfigureRequest(ev xproto.ConfigureRequestEvent) {
+	if ev.ValueMask&(xproto.ConfigWindowWidth|xproto.ConfigWindowHeight) != 0 {
+		i.sizeMu.Lock()
+		width, height := i.width, i.height
+		if ev.ValueMask&xproto.ConfigWindowWidth != 0 {
+			width = ev.Width
+		}
+		if ev.ValueMask&xproto.ConfigWindowHeight != 0 {
+			height = ev.Height
+		}
+		i.requestSize(width, height)
+		i.sizeMu.Unlock()
+	}
+	if err := i.applySize(); err != nil {
+		i.log.Debug("resize icon failed", "err", err)
+	}
+	// The request may have been denied or changed, and a configure that
+	// changes nothing does not generate a ConfigureNotify (ICCCM 4.1.5).
+	i.sendConfigureNotify()
+}
+
+// handleConfigure runs on the event loop when the icon window changed size
+// without going through us, as adopted icons and override-redirect windows
+// do.
+func (i *Icon) handleConfigure(ev xproto.ConfigureNotifyEvent) {
+	i.sizeMu.Lock()
+	if ev.Width == i.width && ev.Height == i.height {
+		i.sizeMu.Unlock()
+		return
+	}
+	i.requestSize(ev.Width, ev.Height)
+	i.sizeMu.Unlock()
+	if err := i.applySize(); err != nil {
+		i.log.Debug("resize icon failed", "err", err)
+	}
+}
+
+func (i *Icon) handleSizeHints() {
+	hints := getSizeHints(i.conn, i.Window)
+	i.sizeMu.Lock()
+	i.hints = hints
+	i.sizeMu.Unlock()
+	if err := i.applySize(); err != nil {
+		i.log.Debug("resize icon failed", "err", err)
+	}
+}
+
+func (i *Icon) sendConfigureNotify() {
+	width, height := i.Size()
+	ev := xproto.ConfigureNotifyEvent{
+		Event:            i.Window,
+		Window:           i.Window,
+		AboveSibling:     xproto.WindowNone,
+		Width:            width,
+		Height:           height,
+		OverrideRedirect: false,
+	}
+	xproto.SendEvent(i.conn, false, i.Window, xproto.EventMaskStructureNotify, string(ev.Bytes()))
+}
+
+// constrain applies the hints to a size. Whatever the client asks for, the
+// result stays within the largest slot and aspect ratio allowed.
+func (h sizeHints) constrain(width, height int) (int, int) {
+	if h.maxWidth > 0 {
+		width = min(width, h.maxWidth)
+	}
+	if h.maxHeight > 0 {
+		height = min(height, h.maxHeight)
+	}
+	width, height = max(width, h.minWidth), max(height, h.minHeight)
+	return min(width, config.MaxSlotSize*maxAspect), min(height, config.MaxSlotSize)
+}
+
+// getSizeHints reads the WM_NORMAL_HINTS of win; unset fields stay zero.
+func getSizeHints(conn *xgb.Conn, win xproto.Window) sizeHints {
+	reply, err := xproto.GetProperty(conn, false, win, xproto.AtomWmNormalHints, xproto.AtomWmSizeHints, 0, sizeFieldCount).Reply()
+	if err != nil || reply.Format != 32 || len(reply.Value) < sizeFieldCount*4 {
+		return sizeHints{}
+	}
+	field := func(idx int) int { return int(int32(xgb.Get32(reply.Value[idx*4:]))) }
+	flags := field(sizeFieldFlags)
+
+	var hints sizeHints
+	if flags&sizeHintMinSize != 0 {
+		hints.minWidth, hints.minHeight = max(0, field(sizeFieldMinWidth)), max(0, field(sizeFieldMinHeight))
+	}
+	if flags&sizeHintMaxSize != 0 {
+		hints.maxWidth, hints.maxHeight = max(0, field(sizeFieldMaxWidth)), max(0, field(sizeFieldMaxHeight))
+	}
+	if flags&sizeHintAspect != 0 {
+		minNum, minDen := field(sizeFieldMinAspect), field(sizeFieldMinAspect+1)
+		maxNum, maxDen := field(sizeFieldMaxAspect), field(sizeFieldMaxAspect+1)
+		// A range of ratios leaves the client's own choice; only a single
+		// ratio is enforced.
+		if minDen > 0 && maxDen > 0 && minNum > 0 && minNum*maxDen == maxNum*minDen {
+			hints.aspect = float64(minNum) / float64(minDen)
+		}
+	}
+	return hints
+}
@@ -0,0 +1,279 @@
+package tray
+
+import (
+	"fmt"
+
+	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/xproto"
+)
+
+const (
+	// Source indication for _NET_ACTIVE_WINDOW: 2 means a pager or similar tool.
+	activeWindowSourcePager = 2
+	// IconicState of WM_CHANGE_STATE (ICCCM 4.1.4).
+	wmStateIconic = 3
+)
+
+// ClientWindows returns the top-level windows created by the same X client as
+// the icon. Windows known to the window manager come first.
+func (i *Icon) ClientWindows() ([]xproto.Window, error) {
+	managed, err := getWindowListProperty(i.conn, i.root, i.atoms.NetClientList)
+	if err != nil {
+		return nil, fmt.Errorf("get client list: %w", err)
+	}
+	tree, err := xproto.QueryTree(i.conn, i.root).Reply()
+	if err != nil {
+		return nil, fmt.Errorf("query tree: %w", err)
+	}
+
+	seen := make(map[xproto.Window]bool)
+	var windows []xproto.Window
+	for _, win := range managed {
+		if seen[win] || !i.sameClient(win) {
+			continue
+		}
+		seen[win] = true
+		windows = append(windows, win)
+	}
+	for _, win := range tree.Children {
+		if seen[win] || !i.sameClient(win) || !i.isAppWindow(win) {
+			continue
+		}
+		seen[win] = true
+		windows = append(windows, win)
+	}
+	return windows, nil
+}
+
+// MainWindows returns the top-level windows of the icon's application. Many
+// applications dock their icon from another X connection than their windows,
+// so besides windows of the same client it also picks those with the icon's
+// _NET_WM_PID or client leader. Windows known to the window manager are
+// returned when there are any; the other top-level windows are only searched
+// when there are none.
+func (i *Icon) MainWindows() ([]xproto.Window, error) {
+	managed, err := getWindowListProperty(i.conn, i.root, i.atoms.NetClientList)
+	if err != nil {
+		return nil, fmt.Errorf("get client list: %w", err)
+	}
+
+	pid, leader := i.PID(), i.Leader()
+	sameApp := func(win xproto.Window) bool {
+		if i.sameClient(win) {
+			return true
+		}
+		if pid != 0 {
+			if winPID, err := getCardinalProperty(i.conn, win, i.atoms.NetWMPid); err == nil && winPID == pid {
+				return true
+			}
+		}
+		if leader != 0 {
+			if leaders, err := getWindowListProperty(i.conn, win, i.atoms.ClientLeader); err == nil && len(leaders) > 0 && leaders[0] == leader {
+				return true
+			}
+		}
+		return false
+	}
+
+	seen := map[xproto.Window]bool{i.Window: true, i.Container: true}
+	var windows []xproto.Window
+	for _, win := range managed {
+		if seen[win] || !sameApp(win) {
+			continue
+		}
+		seen[win] = true
+		windows = append(windows, win)
+	}
+	if len(windows) > 0 {
+		return windows, nil
+	}
+
+	// Applications hiding to the tray withdraw their windows, which the
+	// window manager then forgets.
+	tree, err := xproto.QueryTree(i.conn, i.root).Reply()
+	if err != nil {
+		return nil, fmt.Errorf("query tree: %w", err)
+	}
+	for _, win := range tree.Children {
+		// isAppWindow rules out most root children in fewer round trips.
+		if seen[win] || !i.isAppWindow(win) || !sameApp(win) {
+			continue
+		}
+		seen[win] = true
+		windows = append(windows, win)
+	}
+	return windows, nil
+}
+
+// RaiseMainWindow asks the window manager to activate the application's main
+// window, mapping it first if the application hid it to the tray.
+func (i *Icon) RaiseMainWindow() error {
+	win, _, err := i.mainWindow()
+	if err != nil {
+		return err
+	}
+	i.activate(win)
+	return nil
+}
+
+// ToggleMainWindow iconifies the application's main window when it is the
+// active window and raises it otherwise. It reports whether the window is
+// shown afterwards.
+func (i *Icon) ToggleMainWindow() (bool, error) {
+	win, viewable, err := i.mainWindow()
+	if err != nil {
+		return false, err
+	}
+	active, err := getWindowListProperty(i.conn, i.root, i.atoms.NetActiveWin)
+	if err != nil {
+		return false, fmt.Errorf("get active window: %w", err)
+	}
+	if !viewable || len(active) == 0 || active[0] != win {
+		i.activate(win)
+		return true, nil
+	}
+
+	// Ask the window manager to iconify it (ICCCM 4.1.4). The window stays
+	// managed, so raising it again finds it in the client list.
+	ev := xproto.ClientMessageEvent{
+		Format: 32,
+		Window: win,
+		Type:   i.atoms.WMChangeState,
+		Data:   xproto.ClientMessageDataUnionData32New([]uint32{wmStateIconic, 0, 0, 0, 0}),
+	}
+	mask := uint32(xproto.EventMaskSubstructureRedirect | xproto.EventMaskSubstructureNotify)
+	xproto.SendEvent(i.conn, false, i.root, mask, string(ev.Bytes()))
+	i.conn.Sync()
+	return false, nil
+}
+
+// mainWindow returns the first normal window of MainWindows, preferring a
+// viewable one, and whether it is viewable.
+func (i *Icon) mainWindow() (xproto.Window, bool, error) {
+	windows, err := i.MainWindows()
+	if err != nil {
+		return 0, false, err
+	}
+	var hidden xproto.Window
+	for _, win := range windows {
+		if !i.isNormalWindow(win) {
+			continue
+		}
+		attrs, err := xproto.GetWindowAttributes(i.conn, win).Reply()
+		if err != nil {
+			continue
+		}
+		if attrs.MapState == xproto.MapStateViewable {
+			return win, true, nil
+		}
+		if hidden == 0 {
+			hidden = win
+		}
+	}
+	if hidden == 0 {
+		return 0, false, fmt.Errorf("no top-level window found for icon 0x%x", i.Window)
+	}
+	return hidden, false, nil
+}
+
+// isNormalWindow filters out dialogs, toolbars and the like: windows that are
+// transient for another or whose _NET_WM_WINDOW_TYPE is not NORMAL. Windows
+// without a type count as normal.
+func (i *Icon) isNormalWindow(win xproto.Window) bool {
+	if owners, err := getWindowListProperty(i.conn, win, xproto.AtomWmTransientFor); err != nil || (len(owners) > 0 && owners[0] != xproto.WindowNone) {
+		return false
+	}
+	types, err := getAtomListProperty(i.conn, win, i.atoms.NetWMWindowType)
+	if err != nil {
+		return false
+	}
+	return len(types) == 0 || types[0] == i.atoms.NetWMWindowTypeNormal
+}
+
+// activate maps win if the application hid it and asks the window manager to
+// activate it.
+func (i *Icon) activate(win xproto.Window) {
+	attrs, err := xproto.GetWindowAttributes(i.conn, win).Reply()
+	if err == nil && attrs.MapState == xproto.MapStateUnmapped {
+		xproto.MapWindow(i.conn, win)
+	}
+
+	ev := xproto.ClientMessageEvent{
+		Format: 32,
+		Window: win,
+		Type:   i.atoms.NetActiveWin,
+		Data: xproto.ClientMessageDataUnionData32New([]uint32{
+			activeWindowSourcePager,
+			uint32(xproto.TimeCurrentTime),
+			0,
+			0,
+			0,
+		}),
+	}
+	mask := uint32(xproto.EventMaskSubstructureRedirect | xproto.EventMaskSubstructureNotify)
+	xproto.SendEvent(i.conn, false, i.root, mask, string(ev.Bytes()))
+	i.conn.Sync()
+}
+
+// KillClient forcibly closes the X connection of the application owning the icon.
+func (i *Icon) KillClient() {
+	xproto.KillClient(i.conn, uint32(i.Window))
+	i.conn.Sync()
+}
+
+// sameClient reports whether win was allocated by the client owning the icon.
+func (i *Icon) sameClient(win xproto.Window) bool {
+	mask := xproto.Setup(i.conn).ResourceIdMask
+	return uint32(win)&^mask == uint32(i.Window)&^mask && win != i.Window
+}
+
+// isAppWindow filters out helper windows that are not meant to be shown.
+func (i *Icon) isAppWindow(win xproto.Window) bool {
+	attrs, err := xproto.GetWindowAttributes(i.conn, win).Reply()
+	if err != nil || attrs.OverrideRedirect || attrs.Class == xproto.WindowClassInputOnly {
+		return false
+	}
+	if title, err := getUTF8Property(i.conn, win, i.atoms.NetWMName, i.atoms.UTF8String); err == nil && title != "" {
+		return true
+	}
+	if title, err := getStringProperty(i.conn, win, i.atoms.WMName); err == nil && title != "" {
+		return true
+	}
+	return false
+}
+
+func getAtomListProperty(conn *xgb.Conn, win xproto.Window, atom xproto.Atom) ([]xproto.Atom, error) {
+	if atom == xproto.AtomNone {
+		return nil, nil
+	}
+	reply, err := xproto.GetProperty(conn, false, win, atom, xproto.AtomAtom, 0, (1<<32)-1).Reply()
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil || reply.Format != 32 {
+		return nil, nil
+	}
+	atoms := make([]xproto.Atom, 0, reply.ValueLen)
+	for idx := 0; idx+4 <= len(reply.Value); idx += 4 {
+		atoms = append(atoms, xproto.Atom(xgb.Get32(reply.Value[idx:])))
+	}
+	return atoms, nil
+}
+
+func getWindowListProperty(conn *xgb.Conn, win xproto.Window, atom xproto.Atom) ([]xproto.Window, error) {
+	if atom == xproto.AtomNone {
+		return nil, nil
+	}
+	reply, err := xproto.GetProperty(conn, false, win, atom, xproto.AtomWindow, 0, (1<<32)-1).Reply()
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil || reply.Format != 32 {
+		return nil, nil
+	}
+	windows := make([]xproto.Window, 0, reply.ValueLen)
+	for idx := 0; idx+4 <= len(reply.Value); idx += 4 {
+		windows = append(windows, xproto.Window(xgb.Get32(reply.Value[idx:])))
+	}
+	return windows, nil
+}
@@ -0,0 +1,510 @@
+// Package bridge docks the icons of the X11 system tray and publishes them to
+// sinks, such as StatusNotifierItems on the session bus. It is what the
+// xtrayhide daemon runs; programs such as bars can embed it to show legacy
+// tray icons themselves.
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jezek/xgb/xproto"
+
+	"github.com/bnema/xtrayhide/internal/config"
+	"github.com/bnema/xtrayhide/internal/control"
+	"github.com/bnema/xtrayhide/internal/dump"
+	"github.com/bnema/xtrayhide/internal/handoff"
+	"github.com/bnema/xtrayhide/internal/sni"
+	"github.com/bnema/xtrayhide/internal/tray"
+)
+
+const (
+	// DumpDocked captures icons once none docked for dumpSettle, or after
+	// dumpTimeout at the latest.
+	dumpSettle  = 2 * time.Second
+	dumpTimeout = 10 * time.Second
+
+	// How long to wait for the icons to be released on shutdown.
+	shutdownTimeout = 5 * time.Second
+)
+
+var (
+	// ErrNotRunning is returned by the methods of a Bridge that Run did not
+	// start, such as one running DumpDocked.
+	ErrNotRunning = errors.New("bridge not running")
+	// ErrStopped is returned by the methods of a Bridge once Run stopped.
+	ErrStopped = errors.New("bridge stopped")
+)
+
+// Options configure a Bridge.
+type Options struct {
+	// ConfigPath is the configuration file with the per-application rules.
+	// When empty, the daemon's default path is used.
+	ConfigPath string
+	// Sinks receive the bridged icons. When nil, icons are exported as
+	// StatusNotifierItems, as with []Sink{SNI()}.
+	Sinks []Sink
+	// Replace takes over the icons of a running instance instead of
+	// making their clients dock again.
+	Replace bool
+	// Handoff lets instances started with Replace take over from this one.
+	Handoff bool
+	// Control exports the control interface on the session bus.
+	Control bool
+	// WatchConfig reloads the configuration when its file changes.
+	WatchConfig bool
+	// DumpDir, when set, receives every published capture as PNG.
+	DumpDir string
+	// OnReady, when set, is called by Run once the tray is held and the
+	// bridge serves icons and calls, as for a readiness notification.
+	OnReady func()
+}
+
+// Bridge owns the system tray selection and publishes the docked icons to
+// its sinks according to the configuration.
+type Bridge struct {
+	opts    Options
+	manager *tray.Manager
+	cfg     *config.Config
+	cfgPath string
+	sinks   []Sink
+	// scale is the Xft.dpi scale factor applied to slot sizes.
+	scale   float64
+	started time.Time
+	icons   map[xproto.Window]*iconEntry
+	ids     *idAllocator
+	control *control.Server
+	dump    *dump.Dumper
+	// inspectOnly keeps icons docked without bridging them (DumpDocked).
+	inspectOnly bool
+	// prev is the instance taken over with Replace, until Run completes
+	// the handoff.
+	prev *predecessor
+	// handedOver holds the ids icons had in the instance they were taken
+	// over from, so they keep their bus names.
+	handedOver map[xproto.Window]string
+	// handingOver is set while the icons are parked for a successor.
+	handingOver bool
+	// adopting is set while the icons taken over are added.
+	adopting bool
+
+	// docked and bridged mirror the icon counts for Counts.
+	docked  atomic.Int32
+	bridged atomic.Int32
+
+	calls chan func()
+	// running is closed once Run serves calls, stopped once it no longer
+	// does.
+	running   chan struct{}
+	stopped   chan struct{}
+	startOnce sync.Once
+	closeOnce sync.Once
+}
+
+// New takes the system tray selection, or the icons of the running instance
+// with Options.Replace, and loads the configuration. Icons are managed once
+// Run is called; a Bridge that is not run must be closed.
+func New(opts Options) (*Bridge, error) {
+	cfgPath := opts.ConfigPath
+	if cfgPath == "" {
+		cfgPath = config.DefaultPath()
+	}
+	sinks := opts.Sinks
+	if sinks == nil {
+		sinks = []Sink{SNI()}
+	}
+
+	var (
+		prev    *predecessor
+		manager *tray.Manager
+		err     error
+	)
+	if opts.Replace {
+		if prev, err = takeOver(); err != nil {
+			return nil, fmt.Errorf("replace running instance: %w", err)
+		}
+	}
+	if prev != nil {
+		manager = prev.manager
+	} else if manager, err = tray.NewManager(); err != nil {
+		return nil, fmt.Errorf("tray manager: %w", err)
+	}
+	slog.Info("acquired system tray selection, waiting for icons")
+
+	b := &Bridge{
+		opts:    opts,
+		manager: manager,
+		cfgPath: cfgPath,
+		sinks:   sinks,
+		scale:   manager.ScaleFactor(),
+		started: time.Now(),
+		icons:   make(map[xproto.Window]*iconEntry),
+		ids:     newIDAllocator(),
+		prev:    prev,
+		calls:   make(chan func()),
+		running: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	// Fail early when the session bus is unreachable; items use their own
+	// connections.
+	if slices.ContainsFunc(sinks, isSNI) {
+		bus, err := sni.Connect()
+		if err != nil {
+			b.Close()
+			return nil, fmt.Errorf("dbus session bus: %w", err)
+		}
+		bus.Close()
+	}
+
+	if opts.DumpDir != "" {
+		dumper, err := dump.New(opts.DumpDir)
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+		b.dump = dumper
+		slog.Info("dumping captures", "dir", opts.DumpDir)
+	}
+
+	cfg, err := config.Load(cfgPath)
+	if err != nil {
+		slog.Warn("config not loaded, using defaults", "err", err)
+		cfg = &config.Config{}
+	} else if len(cfg.Rules) > 0 {
+		slog.Info("config loaded", "rules", len(cfg.Rules), "path", cfgPath)
+	}
+	b.cfg = cfg
+	return b, nil
+}
+
+// Close releases the tray of a Bridge that is not run. Until the adopted
+// icons are bridged, it lets the instance they were taken over from resume.
+func (b *Bridge) Close() {
+	b.closeOnce.Do(func() {
+		if b.prev != nil && b.prev.session != nil {
+			b.prev.session.Close()
+		}
+		b.manager.Conn.Close()
+	})
+}
+
+// Run manages the tray and publishes its icons until ctx is done, then
+// withdraws them and hands the icons back to the root window. It returns an
+// error when the tray stops on its own. A Bridge runs once: Run fails after
+// Run or DumpDocked.
+func (b *Bridge) Run(ctx context.Context) error {
+	if err := b.start(); err != nil {
+		return err
+	}
+	defer b.Close()
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	// Calls wait for the loop below from now on.
+	close(b.running)
+
+	if prev := b.prev; prev != nil {
+		b.handedOver = prev.ids
+		b.adopting = true
+		for _, icon := range prev.adopted {
+			b.add(icon)
+		}
+		b.adopting = false
+		if err := prev.session.Complete(); err != nil {
+			slog.Warn("complete handoff", "err", err)
+		}
+		prev.session = nil
+	}
+
+	if b.opts.Control {
+		if bus, err := sni.Connect(); err != nil {
+			slog.Warn("control interface disabled", "err", err)
+		} else if server, err := control.NewServer(bus, controlBackend{b}); err != nil {
+			slog.Warn("control interface disabled", "err", err)
+			bus.Close()
+		} else {
+			defer bus.Close()
+			b.control = server
+			slog.Info("control interface available", "bus_name", control.BusName)
+		}
+	}
+
+	if b.opts.Handoff {
+		if ln, err := handoff.Listen(handoff.SocketPath(), handoffHandler{b: b, exit: stop}); err != nil {
+			slog.Warn("handoff socket disabled", "err", err)
+		} else {
+			defer ln.Close()
+		}
+	}
+
+	var cfgChanged <-chan struct{}
+	if b.opts.WatchConfig {
+		var err error
+		if cfgChanged, err = config.Watch(ctx, b.cfgPath); err != nil {
+			slog.Warn("config watch disabled", "err", err)
+		}
+	}
+
+	failed := make(chan error, 1)
+	stopManager := startManager(b.manager, failed)
+
+	// Nothing blocks between here and the loop serving icons and calls.
+	if b.opts.OnReady != nil {
+		b.opts.OnReady()
+	}
+	events := b.manager.Events()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				// The tray stopped on its own; failed ends the loop.
+				events = nil
+				continue
+			}
+			b.handleEvent(ev)
+
+		case fn := <-b.calls:
+			fn()
+
+		case _, ok := <-cfgChanged:
+			if !ok {
+				cfgChanged = nil
+				continue
+			}
+			if err := b.reload(); err != nil {
+				slog.Error("config reload failed, keeping previous config", "err", err)
+			}
+
+		case err := <-failed:
+			b.shutdown()
+			stopManager()
+			return fmt.Errorf("tray manager stopped: %w", err)
+
+		case <-ctx.Done():
+			b.shutdown()
+			stopManager()
+			return nil
+		}
+	}
+}
+
+// DumpDocked is run instead of Run to inspect the tray: it collects the icons
+// docking, captures them into Options.DumpDir once they stopped arriving,
+// without bridging them, and returns how many it wrote. Like Run, it may only
+// be called once.
+func (b *Bridge) DumpDocked(ctx context.Context) (int, error) {
+	if err := b.start(); err != nil {
+		return 0, err
+	}
+	defer b.Close()
+	if b.dump == nil {
+		return 0, fmt.Errorf("no dump directory set")
+	}
+	b.inspectOnly = true
+	failed := make(chan error, 1)
+	stopManager := startManager(b.manager, failed)
+	defer stopManager()
+
+	settle := time.NewTimer(dumpSettle)
+	deadline := time.After(dumpTimeout)
+	events := b.manager.Events()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			b.handleEvent(ev)
+			if ev.Kind == tray.IconAdded {
+				settle.Reset(dumpSettle)
+			}
+
+		case err := <-failed:
+			return 0, fmt.Errorf("tray manager stopped: %w", err)
+
+		case <-settle.C:
+			return b.dumpAll(), nil
+
+		case <-deadline:
+			return b.dumpAll(), nil
+
+		case <-ctx.Done():
+			return 0, nil
+		}
+	}
+}
+
+// start guards Run and DumpDocked, which take over the Bridge for good.
+func (b *Bridge) start() error {
+	first := false
+	b.startOnce.Do(func() { first = true })
+	if !first {
+		return fmt.Errorf("bridge already run")
+	}
+	return nil
+}
+
+// startManager runs the tray event loop in the background, sending its error
+// to failed if it stops on its own. The returned function stops it and waits
+// until the icons were handed back to the root window; icons must be
+// withdrawn first so nothing maps the released icons again.
+func startManager(manager *tray.Manager, failed chan<- error) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		if err := manager.Run(ctx); err != nil {
+			failed <- err
+		}
+	}()
+	return func() {
+		cancel()
+		timeout := time.After(shutdownTimeout)
+		for {
+			select {
+			// Late dock events are dropped; the channel closes once Run
+			// returned.
+			case _, ok := <-manager.Events():
+				if !ok {
+					return
+				}
+			case <-timeout:
+				slog.Warn("tray manager did not stop in time")
+				return
+			}
+		}
+	}
+}
+
+func (b *Bridge) handleEvent(ev tray.Event) {
+	switch ev.Kind {
+	case tray.IconAdded:
+		b.add(ev.Icon)
+	case tray.IconRemoved:
+		b.remove(ev.Icon)
+	}
+}
+
+// shutdown withdraws every icon once Run stops.
+func (b *Bridge) shutdown() {
+	close(b.stopped)
+	slog.Info("shutting down", "icons", len(b.icons))
+	for _, entry := range b.icons {
+		b.withdraw(entry)
+	}
+}
+
+// The methods below may be called from any goroutine but sinks; they run on
+// the loop of Run through do so the bridge state is never shared. They fail
+// with ErrNotRunning until Run started and with ErrStopped once it stopped.
+
+// Reload loads the configuration file again and applies it to the docked
+// icons. On error the current configuration is kept.
+func (b *Bridge) Reload() error {
+	return b.do(b.reload)
+}
+
+// Icons returns the bridged icons, ordered by id.
+func (b *Bridge) Icons() ([]*Icon, error) {
+	var icons []*Icon
+	err := b.do(func() error {
+		for _, entry := range b.icons {
+			if entry.proxy != nil {
+				icons = append(icons, b.snapshot(entry))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(icons, func(a, b *Icon) int { return strings.Compare(a.ID, b.ID) })
+	return icons, nil
+}
+
+// Click sends an X button to the bridged icon with the given id or window id.
+func (b *Bridge) Click(icon string, button uint8) error {
+	if button == 0 {
+		return fmt.Errorf("invalid button 0")
+	}
+	return b.do(func() error {
+		entry, err := b.lookup(icon)
+		if err != nil {
+			return err
+		}
+		entry.proxy.Click(button)
+		return nil
+	})
+}
+
+// Recapture captures and publishes the bridged icon with the given id or
+// window id even if it did not change.
+func (b *Bridge) Recapture(icon string) error {
+	return b.do(func() error {
+		entry, err := b.lookup(icon)
+		if err != nil {
+			return err
+		}
+		entry.proxy.Recapture()
+		return nil
+	})
+}
+
+// Counts returns how many icons are docked and how many of them are bridged,
+// the others being ignored by the configuration. Unlike the other methods,
+// sinks may call it.
+func (b *Bridge) Counts() (docked, bridged int) {
+	return int(b.docked.Load()), int(b.bridged.Load())
+}
+
+// Ping checks that both the X event loop and the loop of Run keep
+// dispatching, waiting at most timeout for each.
+func (b *Bridge) Ping(timeout time.Duration) error {
+	if err := b.manager.Ping(timeout); err != nil {
+		return fmt.Errorf("tray manager: %w", err)
+	}
+	result := make(chan error, 1)
+	go func() { result <- b.do(func() error { return nil }) }()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("bridge loop: no answer within %v", timeout)
+	}
+}
+
+// do runs fn on the loop of Run and returns its error, or ErrNotRunning or
+// ErrStopped without running it when there is no loop.
+func (b *Bridge) do(fn func() error) error {
+	select {
+	case <-b.running:
+	default:
+		return ErrNotRunning
+	}
+	var err error
+	done := make(chan struct{})
+	select {
+	case b.calls <- func() { err = fn(); close(done) }:
+		<-done
+		return err
+	case <-b.stopped:
+		return ErrStopped
+	}
+}
+
+// post runs fn on the loop of Run without waiting for it. fn is dropped when
+// there is no loop.
+func (b *Bridge) post(fn func()) {
+	go b.do(func() error {
+		fn()
+		return nil
+	})
+}
@@ -0,0 +1,159 @@
+package bridge
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jezek/xgb/xproto"
+
+	"github.com/bnema/xtrayhide/internal/control"
+)
+
+const maxShowSeconds = 300
+
+// controlBackend serves the control interface. Its methods are called from
+// D-Bus goroutines and run on the loop of Run through do.
+type controlBackend struct {
+	*Bridge
+}
+
+func (c controlBackend) Icons() ([]control.IconInfo, error) {
+	var icons []control.IconInfo
+	err := c.do(func() error {
+		for _, entry := range c.icons {
+			icons = append(icons, c.info(entry))
+		}
+		return nil
+	})
+	return icons, err
+}
+
+func (c controlBackend) Status() control.Status {
+	docked, bridged := c.Counts()
+	return control.Status{
+		PID:     uint32(os.Getpid()),
+		Uptime:  uint64(time.Since(c.started).Seconds()),
+		Icons:   uint32(docked),
+		Bridged: uint32(bridged),
+		Config:  c.cfgPath,
+	}
+}
+
+// Capture runs on the loop, so the icon cannot be removed while it is
+// captured.
+func (c controlBackend) Capture(icon string) ([]byte, error) {
+	var img image.Image
+	err := c.do(func() error {
+		entry, err := c.find(icon)
+		if err != nil {
+			return err
+		}
+		img, err = entry.icon.CaptureImage()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("encode png: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (c controlBackend) ShowWindow(icon string, seconds uint32) error {
+	if seconds == 0 || seconds > maxShowSeconds {
+		return fmt.Errorf("seconds must be between 1 and %d", maxShowSeconds)
+	}
+	return c.do(func() error {
+		entry, err := c.find(icon)
+		if err != nil {
+			return err
+		}
+		// A new request restarts the delay.
+		c.stopShowing(entry)
+		entry.icon.Show(0, 0)
+		var timer *time.Timer
+		timer = time.AfterFunc(time.Duration(seconds)*time.Second, func() {
+			c.post(func() {
+				if entry.hideTimer == timer {
+					entry.hideTimer = nil
+					entry.icon.Hide()
+				}
+			})
+		})
+		entry.hideTimer = timer
+		return nil
+	})
+}
+
+// stopShowing cancels hiding entry after ShowWindow, reporting whether it
+// was shown.
+func (b *Bridge) stopShowing(entry *iconEntry) bool {
+	if entry.hideTimer == nil {
+		return false
+	}
+	entry.hideTimer.Stop()
+	entry.hideTimer = nil
+	return true
+}
+
+// find returns the icon with the given SNI id or window id.
+func (b *Bridge) find(icon string) (*iconEntry, error) {
+	if win, err := strconv.ParseUint(icon, 0, 32); err == nil {
+		if entry, ok := b.icons[xproto.Window(win)]; ok {
+			return entry, nil
+		}
+	}
+	for _, entry := range b.icons {
+		if entry.id != "" && entry.id == icon {
+			return entry, nil
+		}
+	}
+	return nil, fmt.Errorf("no such icon: %s", icon)
+}
+
+// lookup is like find but only returns bridged icons.
+func (b *Bridge) lookup(icon string) (*iconEntry, error) {
+	entry, err := b.find(icon)
+	if err != nil {
+		return nil, err
+	}
+	if entry.proxy == nil {
+		return nil, fmt.Errorf("icon %s is not bridged", icon)
+	}
+	return entry, nil
+}
+
+func (b *Bridge) info(e *iconEntry) control.IconInfo {
+	instance, class := e.target.Instance, e.target.Class
+	info := control.IconInfo{
+		ID:        e.id,
+		Window:    uint32(e.icon.Window),
+		Container: uint32(e.icon.Container),
+		Title:     e.title,
+		Instance:  instance,
+		Class:     class,
+		PID:       e.app.PID,
+		Status:    "Ignored",
+	}
+	if e.proxy != nil {
+		info.Status = "Active"
+		if e.proxy.NeedsAttention() {
+			info.Status = "NeedsAttention"
+		}
+		if item := b.sniItem(e); item != nil {
+			info.Service = item.Service()
+			info.Status = item.Status()
+		}
+		if last := e.proxy.LastCapture(); !last.IsZero() {
+			info.LastCapture = last.UnixMilli()
+		}
+	}
+	return info
+}
@@ -0,0 +1,139 @@
+package bridge
+
+import (
+	"log/slog"
+
+	"github.com/jezek/xgb/xproto"
+
+	"github.com/bnema/xtrayhide/internal/handoff"
+	"github.com/bnema/xtrayhide/internal/proxy"
+	"github.com/bnema/xtrayhide/internal/tray"
+)
+
+// handoffHandler hands the bridge's icons to a new instance started with
+// --replace.
+type handoffHandler struct {
+	b    *Bridge
+	exit func()
+}
+
+func (h handoffHandler) Prepare() (handoff.State, error) {
+	var state handoff.State
+	err := h.b.do(func() error {
+		icons := make([]*tray.Icon, 0, len(h.b.icons))
+		for _, entry := range h.b.icons {
+			icons = append(icons, entry.icon)
+			state.Icons = append(state.Icons, handoff.Icon{
+				Window:    uint32(entry.icon.Window),
+				Container: uint32(entry.icon.Container),
+				ID:        entry.id,
+			})
+		}
+		if err := h.b.manager.Retain(icons); err != nil {
+			h.b.manager.Unretain(icons)
+			return err
+		}
+		for _, win := range h.b.manager.RetainedTrays() {
+			state.Trays = append(state.Trays, uint32(win))
+		}
+		// The sinks keep the icons until the successor took them over, so
+		// hosts never see them go away.
+		h.b.handingOver = true
+		for _, entry := range h.b.icons {
+			h.b.park(entry)
+		}
+		slog.Info("handing icons over to new instance", "icons", len(state.Icons))
+		return nil
+	})
+	return state, err
+}
+
+func (h handoffHandler) Complete() {
+	slog.Info("new instance took over")
+	h.exit()
+}
+
+func (h handoffHandler) Abort() {
+	slog.Warn("handoff aborted, resuming")
+	err := h.b.do(func() error {
+		icons := make([]*tray.Icon, 0, len(h.b.icons))
+		for _, entry := range h.b.icons {
+			icons = append(icons, entry.icon)
+		}
+		h.b.manager.Unretain(icons)
+		h.b.handingOver = false
+		for _, entry := range h.b.icons {
+			h.b.unpark(entry)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Warn("resume after handoff failed", "err", err)
+	}
+}
+
+// park stops bridging entry but leaves it with the sinks.
+func (b *Bridge) park(entry *iconEntry) {
+	if entry.proxy == nil {
+		return
+	}
+	if b.stopShowing(entry) {
+		entry.icon.Hide()
+	}
+	entry.proxy.Close()
+	entry.proxy = nil
+	entry.parked = true
+}
+
+// unpark bridges a parked entry again, publishing to what the sinks kept.
+func (b *Bridge) unpark(entry *iconEntry) {
+	if !entry.parked {
+		return
+	}
+	entry.parked = false
+	entry.proxy = proxy.New(b.manager.Conn, b.manager.Root, entry.icon, b.proxyOptions(entry))
+	entry.proxy.Recapture()
+	entry.proxy.SetChangeHandler(func() { b.proxyChanged(entry) })
+	if item := b.sniItem(entry); item != nil {
+		entry.proxy.SetItem(item)
+	}
+	b.changed(entry)
+}
+
+// predecessor is what a new instance started with --replace took over.
+type predecessor struct {
+	manager *tray.Manager
+	adopted []*tray.Icon
+	// ids maps adopted icon windows to their SNI ids.
+	ids     map[xproto.Window]string
+	session *handoff.Session
+}
+
+// takeOver replaces the running daemon, adopting its icons. It returns nil
+// when no daemon answers, so the caller starts normally.
+func takeOver() (*predecessor, error) {
+	session, state, err := handoff.Request(handoff.SocketPath())
+	if err != nil {
+		slog.Info("no running instance to replace", "err", err)
+		return nil, nil
+	}
+	trays := make([]xproto.Window, 0, len(state.Trays))
+	for _, win := range state.Trays {
+		trays = append(trays, xproto.Window(win))
+	}
+	adopt := make([]tray.Embedded, 0, len(state.Icons))
+	ids := make(map[xproto.Window]string)
+	for _, icon := range state.Icons {
+		adopt = append(adopt, tray.Embedded{Window: xproto.Window(icon.Window), Container: xproto.Window(icon.Container)})
+		if icon.ID != "" {
+			ids[xproto.Window(icon.Window)] = icon.ID
+		}
+	}
+	manager, adopted, err := tray.TakeOver(adopt, trays)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	slog.Info("took over from running instance", "icons", len(adopted))
+	return &predecessor{manager: manager, adopted: adopted, ids: ids, session: session}, nil
+}
@@ -0,0 +1,95 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+const (
+	// How long a finished hook may keep its output open, through processes
+	// it left behind, before it is considered done.
+	hookWaitDelay = time.Second
+	// Hook output logged on failure is cut at maxHookOutput bytes.
+	maxHookOutput = 512
+)
+
+// hook runs command in the background for event on entry, passing the icon
+// in XTRAYHIDE_* variables. Nothing runs when command is empty.
+func (b *Bridge) hook(entry *iconEntry, event, command string) {
+	if command == "" {
+		return
+	}
+	var service, pid string
+	if item := b.sniItem(entry); item != nil {
+		service = item.Service()
+	}
+	if entry.app.PID != 0 {
+		pid = fmt.Sprint(entry.app.PID)
+	}
+	env := append(os.Environ(),
+		"XTRAYHIDE_EVENT="+event,
+		"XTRAYHIDE_ID="+entry.id,
+		fmt.Sprintf("XTRAYHIDE_WINDOW=0x%x", uint32(entry.icon.Window)),
+		"XTRAYHIDE_INSTANCE="+entry.target.Instance,
+		"XTRAYHIDE_CLASS="+entry.target.Class,
+		"XTRAYHIDE_PID="+pid,
+		"XTRAYHIDE_TITLE="+b.itemTitle(entry),
+		"XTRAYHIDE_SERVICE="+service,
+	)
+	timeout := time.Duration(entry.settings.Hooks.Timeout) * time.Second
+	go runHook(command, env, timeout, entry.log.With("hook", event))
+}
+
+// hookChanges runs the title and attention hooks when the icon's window
+// title or snapshot differ from what entry last reported. A configured title
+// hides changes from the sinks but not from the hooks.
+func (b *Bridge) hookChanges(entry *iconEntry, snapshot *Icon) {
+	if title := entry.icon.WindowTitle(); title != entry.windowTitle {
+		entry.windowTitle = title
+		b.hook(entry, "title", entry.settings.Hooks.Title)
+	}
+	if snapshot.NeedsAttention != entry.attention {
+		entry.attention = snapshot.NeedsAttention
+		if entry.attention {
+			b.hook(entry, "attention", entry.settings.Hooks.Attention)
+		}
+	}
+}
+
+func runHook(command string, env []string, timeout time.Duration, log *slog.Logger) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = env
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// Kill whatever the shell started along with it.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+	cmd.WaitDelay = hookWaitDelay
+
+	log.Debug("running hook", "command", command)
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Warn("hook timed out", "command", command, "timeout", timeout)
+		return
+	}
+	if err != nil {
+		output := bytes.TrimSpace(out.Bytes())
+		if len(output) > maxHookOutput {
+			output = output[:maxHookOutput]
+		}
+		log.Warn("hook failed", "command", command, "err", err, "output", string(output))
+	}
+}
@@ -0,0 +1,367 @@
+package bridge
+
+import (
+	"fmt"
+	"image"
+	"log/slog"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/bnema/xtrayhide/internal/config"
+	"github.com/bnema/xtrayhide/internal/icontheme"
+	"github.com/bnema/xtrayhide/internal/proxy"
+	"github.com/bnema/xtrayhide/internal/sni"
+	"github.com/bnema/xtrayhide/internal/tray"
+)
+
+type iconEntry struct {
+	icon     *tray.Icon
+	app      tray.App
+	title    string
+	target   config.Target
+	settings config.Settings
+	// sizes are the pixmap sizes published, the largest being the slot.
+	sizes []int
+	// iconName and images are the icon set by the configuration, images
+	// being empty when captures are published instead.
+	iconName string
+	images   []image.Image
+	// proxy is set while the icon is bridged.
+	proxy *proxy.Proxy
+	// parked is set while the proxy is stopped for a handoff, the sinks
+	// keeping the icon.
+	parked bool
+	// pending is set while a change of the proxy waits for the loop.
+	pending atomic.Bool
+	// windowTitle and attention are the state hooks last saw.
+	windowTitle string
+	attention   bool
+	id          string
+	log         *slog.Logger
+	// hideTimer hides the icon again after ShowWindow.
+	hideTimer *time.Timer
+}
+
+func (b *Bridge) add(icon *tray.Icon) {
+	title := icon.WindowTitle()
+	instance, class := icon.WMClass()
+	app := icon.App()
+	if title == "" {
+		title = app.Name
+	}
+	if title == "" {
+		title = icon.Title()
+	}
+	logger := icon.Logger().With("class", class)
+	logger.Info("icon docked", "title", title, "instance", instance, "pid", app.PID, "exe", app.Executable, "desktop_id", app.DesktopID)
+
+	entry := &iconEntry{
+		icon:  icon,
+		app:   app,
+		title: title,
+		log:   logger,
+		target: config.Target{
+			Instance:   instance,
+			Class:      class,
+			Title:      title,
+			Executable: app.Executable,
+			DesktopID:  app.DesktopID,
+		},
+	}
+	b.icons[icon.Window] = entry
+	b.docked.Add(1)
+	if b.inspectOnly {
+		return
+	}
+	b.apply(entry, b.cfg.Resolve(entry.target))
+	if b.control != nil {
+		b.control.EmitDocked(b.info(entry))
+	}
+	// Icons taken over from another instance docked long ago.
+	if !b.adopting {
+		b.hook(entry, "docked", entry.settings.Hooks.Docked)
+	}
+}
+
+// reload loads the config file again and re-evaluates its rules against every
+// docked icon, updating them in place. On error the current config is kept.
+func (b *Bridge) reload() error {
+	if b.handingOver {
+		return fmt.Errorf("icons are being handed over")
+	}
+	cfg, err := config.Load(b.cfgPath)
+	if err != nil {
+		return err
+	}
+	slog.Info("config reloaded", "rules", len(cfg.Rules), "path", b.cfgPath)
+	b.cfg = cfg
+	b.scale = b.manager.ScaleFactor()
+	icontheme.Reset()
+	tray.ResetDesktopEntries()
+	for _, entry := range b.icons {
+		// Titles change while icons stay docked; match on the current one.
+		if title := entry.icon.WindowTitle(); title != "" {
+			entry.target.Title = title
+		}
+		b.apply(entry, cfg.Resolve(entry.target))
+	}
+	return nil
+}
+
+// apply bridges, updates or withdraws entry to match settings.
+func (b *Bridge) apply(entry *iconEntry, settings config.Settings) {
+	previous := entry.settings
+	entry.settings = settings
+
+	if settings.Ignore {
+		if entry.proxy != nil {
+			entry.log.Info("icon now ignored by config", "title", entry.title)
+			b.withdraw(entry)
+		} else {
+			entry.log.Info("icon ignored by config", "title", entry.title)
+		}
+		return
+	}
+	if entry.proxy == nil || settings.ID != previous.ID {
+		b.withdraw(entry)
+		b.export(entry)
+		return
+	}
+
+	resized := !slices.Equal(b.captureSizes(settings), entry.sizes) ||
+		settings.Geometry != previous.Geometry || settings.Aspect != previous.Aspect
+	if resized {
+		b.resize(entry)
+	}
+	if settings.Icon != previous.Icon {
+		b.resolveIcon(entry)
+	}
+	entry.proxy.SetOptions(b.proxyOptions(entry))
+	if len(entry.images) == 0 && (resized || settings.Icon != previous.Icon) {
+		entry.proxy.Recapture()
+	}
+	b.changed(entry)
+}
+
+// export bridges entry and hands it to the sinks.
+func (b *Bridge) export(entry *iconEntry) {
+	icon := entry.icon
+	b.resize(entry)
+	b.resolveIcon(entry)
+
+	base := baseID(icon, entry.settings.ID)
+	if previous, ok := b.handedOver[icon.Window]; ok {
+		delete(b.handedOver, icon.Window)
+		base = previous
+	}
+	entry.id = b.ids.Allocate(base)
+	entry.proxy = proxy.New(b.manager.Conn, b.manager.Root, icon, b.proxyOptions(entry))
+	// Capture right away so sinks start with the icon.
+	entry.proxy.Recapture()
+	if img := entry.proxy.Image(); img != nil {
+		entry.log.Debug("captured icon", "width", img.Rect.Dx(), "height", img.Rect.Dy())
+	}
+	entry.proxy.SetChangeHandler(func() { b.proxyChanged(entry) })
+	b.bridged.Add(1)
+
+	snapshot := b.snapshot(entry)
+	for _, sink := range b.sinks {
+		sink.IconAdded(snapshot)
+	}
+	entry.windowTitle, entry.attention = entry.icon.WindowTitle(), false
+	b.hookChanges(entry, snapshot)
+}
+
+// withdraw removes entry from the sinks and stops bridging it.
+func (b *Bridge) withdraw(entry *iconEntry) {
+	if entry.proxy == nil && !entry.parked {
+		return
+	}
+	if b.stopShowing(entry) {
+		entry.icon.Hide()
+	}
+	snapshot := b.snapshot(entry)
+	for _, sink := range b.sinks {
+		sink.IconRemoved(snapshot)
+	}
+	if entry.proxy != nil {
+		entry.proxy.Close()
+	}
+	entry.proxy = nil
+	entry.parked = false
+	b.ids.Release(entry.id)
+	entry.id = ""
+	b.bridged.Add(-1)
+}
+
+// changed tells the sinks the current state of entry.
+func (b *Bridge) changed(entry *iconEntry) {
+	snapshot := b.snapshot(entry)
+	b.hookChanges(entry, snapshot)
+	for _, sink := range b.sinks {
+		sink.IconChanged(snapshot)
+	}
+}
+
+// proxyChanged runs wherever the proxy of entry noticed a change. Changes
+// coalesce until the loop tells the sinks.
+func (b *Bridge) proxyChanged(entry *iconEntry) {
+	if !entry.pending.CompareAndSwap(false, true) {
+		return
+	}
+	b.post(func() {
+		entry.pending.Store(false)
+		if b.icons[entry.icon.Window] == entry && entry.proxy != nil {
+			b.changed(entry)
+		}
+	})
+}
+
+// snapshot returns the current state of the bridged entry for sinks.
+func (b *Bridge) snapshot(entry *iconEntry) *Icon {
+	icon := &Icon{
+		ID:         entry.id,
+		Window:     uint32(entry.icon.Window),
+		Instance:   entry.target.Instance,
+		Class:      entry.target.Class,
+		Title:      b.itemTitle(entry),
+		PID:        entry.app.PID,
+		Executable: entry.app.Executable,
+		DesktopID:  entry.app.DesktopID,
+		IconName:   entry.iconName,
+		Category:   entry.settings.Category,
+		bridge:     b,
+		entry:      entry,
+	}
+	if n := len(entry.images); n > 0 {
+		icon.Image = entry.images[n-1]
+	}
+	// Parked entries have no proxy until the handoff is aborted.
+	if entry.proxy != nil {
+		icon.NeedsAttention = entry.proxy.NeedsAttention()
+		if img := entry.proxy.Image(); icon.Image == nil && img != nil {
+			icon.Image = img
+		}
+	}
+	return icon
+}
+
+func (b *Bridge) resize(entry *iconEntry) {
+	entry.sizes = b.captureSizes(entry.settings)
+	if len(entry.sizes) == 0 {
+		return
+	}
+	slot := uint16(entry.sizes[len(entry.sizes)-1])
+	policy := tray.SizePolicy{
+		Fixed:  entry.settings.Geometry == config.GeometryFixed,
+		Aspect: entry.settings.Aspect,
+	}
+	if err := entry.icon.SetSize(slot, policy); err != nil {
+		entry.log.Warn("resize icon failed", "err", err)
+	}
+}
+
+// itemTitle returns the configured title override or the icon's own title.
+func (b *Bridge) itemTitle(entry *iconEntry) string {
+	if entry.settings.Title != "" {
+		return entry.settings.Title
+	}
+	if title := entry.icon.WindowTitle(); title != "" {
+		return title
+	}
+	return entry.title
+}
+
+// resolveIcon loads the icon the configuration sets for entry. Captures are
+// turned off when it resolves to images.
+func (b *Bridge) resolveIcon(entry *iconEntry) {
+	entry.iconName, entry.images = entry.app.IconName, nil
+	if entry.settings.Icon == "" {
+		return
+	}
+	iconName, images, err := icontheme.Resolve(entry.settings.Icon)
+	if err != nil {
+		entry.log.Warn("icon override failed", "err", err)
+		return
+	}
+	entry.iconName, entry.images = iconName, images
+}
+
+func (b *Bridge) remove(icon *tray.Icon) {
+	entry, ok := b.icons[icon.Window]
+	if !ok {
+		return
+	}
+	entry.log.Info("icon removed", "id", entry.id)
+	b.stopShowing(entry)
+	b.hook(entry, "removed", entry.settings.Hooks.Removed)
+	info := b.info(entry)
+	b.withdraw(entry)
+	delete(b.icons, icon.Window)
+	b.docked.Add(-1)
+	if b.control != nil {
+		b.control.EmitUndocked(info)
+	}
+}
+
+// captureSizes returns the pixmap sizes published for icons with settings s,
+// in increasing order: the configured capture sizes, or the slot size plus
+// the slot size scaled to the Xft.dpi of HiDPI screens.
+func (b *Bridge) captureSizes(s config.Settings) []int {
+	sizes := slices.Clone(s.CaptureSizes)
+	if len(sizes) == 0 && s.SlotSize > 0 {
+		sizes = []int{s.SlotSize}
+		if b.scale > 1 {
+			sizes = append(sizes, min(int(float64(s.SlotSize)*b.scale+0.5), config.MaxSlotSize))
+		}
+	}
+	slices.Sort(sizes)
+	return slices.Compact(sizes)
+}
+
+func (b *Bridge) proxyOptions(entry *iconEntry) proxy.Options {
+	s := entry.settings
+	opts := proxy.DefaultOptions()
+	opts.Sizes = b.captureSizes(s)
+	opts.Dump = b.dump
+	if s.Capture == config.CaptureStatic {
+		opts.Capture = proxy.CaptureOnce
+	}
+	if len(entry.images) > 0 {
+		opts.Capture = proxy.CaptureOff
+	}
+	if s.Input == config.InputXTest {
+		opts.Input = proxy.InputXTest
+	}
+	switch s.Activate {
+	case config.ActivateRaise:
+		opts.Activate = proxy.ActivateRaise
+	case config.ActivateToggle:
+		opts.Activate = proxy.ActivateToggle
+	}
+	opts.ActivateButton = uint8(s.Buttons.Activate)
+	opts.SecondaryButton = uint8(s.Buttons.SecondaryActivate)
+	opts.ContextButton = uint8(s.Buttons.ContextMenu)
+	opts.FixedTitle = s.Title != ""
+	return opts
+}
+
+// dumpAll captures every docked icon, bridged or not, into the dump
+// directory.
+func (b *Bridge) dumpAll() int {
+	count := 0
+	for _, entry := range b.icons {
+		raw, img, err := entry.icon.CaptureRaw()
+		if err != nil {
+			entry.log.Warn("capture failed", "err", err)
+			continue
+		}
+		if err := b.dump.Write(uint32(entry.icon.Window), entry.target.Class, raw, sni.PixmapFromImage(img)); err != nil {
+			entry.log.Warn("dump capture failed", "err", err)
+			continue
+		}
+		count++
+	}
+	return count
+}
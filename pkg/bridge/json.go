@@ -0,0 +1,386 @@
+package bridge
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// Events a JSON client did not read yet; clients falling further behind are
+// disconnected so they never hold up the bridge.
+const jsonQueue = 256
+
+// jsonEvent is a line sent to JSON clients.
+type jsonEvent struct {
+	// Event is "add", "update", "remove" or "error".
+	Event    string `json:"event"`
+	ID       string `json:"id,omitempty"`
+	Window   uint32 `json:"window,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Class    string `json:"class,omitempty"`
+	Title    string `json:"title,omitempty"`
+	PID      uint32 `json:"pid,omitempty"`
+	IconName string `json:"icon_name,omitempty"`
+	// Image is the capture as base64 PNG, or ImagePath the PNG file it was
+	// written to.
+	Image          string `json:"image,omitempty"`
+	ImagePath      string `json:"image_path,omitempty"`
+	NeedsAttention bool   `json:"needs_attention,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// jsonCommand is a line read from JSON clients.
+type jsonCommand struct {
+	Command string `json:"command"`
+	ID      string `json:"id"`
+	Button  uint8  `json:"button"`
+}
+
+// JSONOptions configure a JSON sink.
+type JSONOptions struct {
+	// ImageDir, when set, receives the captures as PNG files named after
+	// the icon ids, which events refer to instead of inlining them.
+	ImageDir string
+}
+
+// JSONSink streams icons as JSON lines to its clients, such as a bar reading
+// standard output or connected to a Unix socket, and clicks icons on their
+// commands. Each client first gets an "add" event per bridged icon.
+type JSONSink struct {
+	opts JSONOptions
+
+	mu      sync.Mutex
+	icons   map[string]*Icon
+	state   map[string]jsonEvent
+	clients map[*jsonClient]struct{}
+	ln      *net.UnixListener
+	// socket is the file ln created, removed by Close unless replaced.
+	socket os.FileInfo
+}
+
+type jsonClient struct {
+	out    chan []byte
+	done   chan struct{}
+	closer io.Closer
+	once   sync.Once
+}
+
+// NewJSON returns a JSON sink without clients; add them with Attach or Listen.
+func NewJSON(opts JSONOptions) (*JSONSink, error) {
+	if opts.ImageDir != "" {
+		if err := os.MkdirAll(opts.ImageDir, 0o755); err != nil {
+			return nil, fmt.Errorf("create image dir: %w", err)
+		}
+	}
+	return &JSONSink{
+		opts:    opts,
+		icons:   make(map[string]*Icon),
+		state:   make(map[string]jsonEvent),
+		clients: make(map[*jsonClient]struct{}),
+	}, nil
+}
+
+// Attach adds a client writing events to w and, unless r is nil, reading
+// commands from r.
+func (s *JSONSink) Attach(r io.Reader, w io.Writer) {
+	s.attach(r, w, nil)
+}
+
+// Listen accepts clients on a Unix socket at path until Close. An existing
+// socket is replaced; any other file there is left alone and fails Listen.
+func (s *JSONSink) Listen(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("create socket dir: %w", err)
+	}
+	if err := removeSocket(path); err != nil {
+		return err
+	}
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return fmt.Errorf("listen %s: %w", path, err)
+	}
+	// Close removes the socket itself, not one that replaced it since.
+	ln.SetUnlinkOnClose(false)
+	info, err := os.Lstat(path)
+	if err != nil {
+		ln.Close()
+		return fmt.Errorf("stat %s: %w", path, err)
+	}
+	s.mu.Lock()
+	s.ln = ln
+	s.socket = info
+	s.mu.Unlock()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.attach(conn, conn, conn)
+		}
+	}()
+	return nil
+}
+
+// Close stops listening and disconnects the clients.
+func (s *JSONSink) Close() error {
+	s.mu.Lock()
+	ln, socket := s.ln, s.socket
+	clients := make([]*jsonClient, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+	for _, c := range clients {
+		s.drop(c)
+	}
+	if ln == nil {
+		return nil
+	}
+	err := ln.Close()
+	path := ln.Addr().String()
+	if info, statErr := os.Lstat(path); statErr == nil && os.SameFile(info, socket) {
+		os.Remove(path)
+	}
+	return err
+}
+
+// removeSocket removes a socket left at path, refusing to remove anything
+// else.
+func removeSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", path, err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("remove stale socket: %w", err)
+	}
+	return nil
+}
+
+func (s *JSONSink) IconAdded(icon *Icon) {
+	s.publish("add", icon)
+}
+
+func (s *JSONSink) IconChanged(icon *Icon) {
+	s.publish("update", icon)
+}
+
+func (s *JSONSink) IconRemoved(icon *Icon) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.icons, icon.ID)
+	delete(s.state, icon.ID)
+	if s.opts.ImageDir != "" {
+		os.Remove(s.imagePath(icon.ID))
+	}
+	s.broadcast(jsonEvent{Event: "remove", ID: icon.ID, Window: icon.Window})
+}
+
+func (s *JSONSink) publish(event string, icon *Icon) {
+	ev := jsonEvent{
+		Event:          "add",
+		ID:             icon.ID,
+		Window:         icon.Window,
+		Instance:       icon.Instance,
+		Class:          icon.Class,
+		Title:          icon.Title,
+		PID:            icon.PID,
+		IconName:       icon.IconName,
+		NeedsAttention: icon.NeedsAttention,
+	}
+	if icon.Image != nil {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, icon.Image); err != nil {
+			slog.Warn("encode icon for json failed", "id", icon.ID, "err", err)
+		} else if s.opts.ImageDir != "" {
+			ev.ImagePath, err = s.writeImage(icon.ID, buf.Bytes())
+			if err != nil {
+				slog.Warn("write icon for json failed", "id", icon.ID, "err", err)
+			}
+		} else {
+			ev.Image = base64.StdEncoding.EncodeToString(buf.Bytes())
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.icons[icon.ID] = icon
+	s.state[icon.ID] = ev
+	ev.Event = event
+	s.broadcast(ev)
+}
+
+func (s *JSONSink) imagePath(id string) string {
+	return filepath.Join(s.opts.ImageDir, id+".png")
+}
+
+// writeImage replaces the image file of the icon id, so that readers never
+// see a partial file.
+func (s *JSONSink) writeImage(id string, data []byte) (string, error) {
+	path := s.imagePath(id)
+	tmp, err := os.CreateTemp(s.opts.ImageDir, "."+id+"-*.png")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return path, nil
+}
+
+// broadcast sends ev to every client. The caller holds mu.
+func (s *JSONSink) broadcast(ev jsonEvent) {
+	line, err := marshalLine(ev)
+	if err != nil {
+		slog.Warn("encode json event failed", "err", err)
+		return
+	}
+	for c := range s.clients {
+		select {
+		case c.out <- line:
+		default:
+			slog.Warn("json client too slow, disconnecting")
+			go s.drop(c)
+		}
+	}
+}
+
+func (s *JSONSink) attach(r io.Reader, w io.Writer, closer io.Closer) {
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.state))
+	for id := range s.state {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	c := &jsonClient{
+		out:    make(chan []byte, jsonQueue+len(ids)),
+		done:   make(chan struct{}),
+		closer: closer,
+	}
+	for _, id := range ids {
+		if line, err := marshalLine(s.state[id]); err == nil {
+			c.out <- line
+		}
+	}
+	s.clients[c] = struct{}{}
+	s.mu.Unlock()
+
+	go s.write(c, w)
+	if r != nil {
+		go s.read(c, r)
+	}
+}
+
+func (s *JSONSink) write(c *jsonClient, w io.Writer) {
+	for {
+		select {
+		case line := <-c.out:
+			if _, err := w.Write(line); err != nil {
+				s.drop(c)
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (s *JSONSink) read(c *jsonClient, r io.Reader) {
+	// Commands are short; an overlong line ends the client like EOF does.
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		if err := s.command(scanner.Bytes()); err != nil {
+			s.reply(c, err)
+		}
+	}
+	// Socket clients are done once they hang up; standard output keeps
+	// getting events after standard input closed.
+	if c.closer != nil {
+		s.drop(c)
+	}
+}
+
+func (s *JSONSink) command(line []byte) error {
+	var cmd jsonCommand
+	if err := json.Unmarshal(line, &cmd); err != nil {
+		return fmt.Errorf("invalid command: %w", err)
+	}
+	switch cmd.Command {
+	case "click":
+		s.mu.Lock()
+		icon, ok := s.icons[cmd.ID]
+		s.mu.Unlock()
+		if !ok {
+			return fmt.Errorf("no such icon: %s", cmd.ID)
+		}
+		button := cmd.Button
+		if button == 0 {
+			button = 1
+		}
+		icon.Click(button)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q", cmd.Command)
+	}
+}
+
+// reply sends an error event to c only.
+func (s *JSONSink) reply(c *jsonClient, err error) {
+	line, encErr := marshalLine(jsonEvent{Event: "error", Error: err.Error()})
+	if encErr != nil {
+		return
+	}
+	select {
+	case c.out <- line:
+	default:
+	}
+}
+
+func (s *JSONSink) drop(c *jsonClient) {
+	c.once.Do(func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+		close(c.done)
+		if c.closer != nil {
+			c.closer.Close()
+		}
+	})
+}
+
+func marshalLine(ev jsonEvent) ([]byte, error) {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
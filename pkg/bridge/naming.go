@@ -0,0 +1,83 @@
+package bridge
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/bnema/xtrayhide/internal/tray"
+)
+
+const idPrefix = "xtrayhide-"
+
+// idAllocator hands out stable SNI ids derived from the application identity,
+// numbering duplicates when an application docks several icons.
+type idAllocator struct {
+	used map[string]bool
+}
+
+func newIDAllocator() *idAllocator {
+	return &idAllocator{used: make(map[string]bool)}
+}
+
+// Allocate returns a unique id starting with base, such as
+// "xtrayhide-discord" or "xtrayhide-discord-2".
+func (a *idAllocator) Allocate(base string) string {
+	id := base
+	for n := 2; a.used[id]; n++ {
+		id = fmt.Sprintf("%s-%d", base, n)
+	}
+	a.used[id] = true
+	return id
+}
+
+func (a *idAllocator) Release(id string) {
+	delete(a.used, id)
+}
+
+// serviceName returns the bus name an item with the given id is published
+// under. Ids are already sanitized to valid bus name characters.
+func serviceName(id string) string {
+	return "org.kde.StatusNotifierItem-" + id
+}
+
+// baseID returns the id an icon should get before deduplication: the rule
+// override when set, else derived from the application.
+func baseID(icon *tray.Icon, override string) string {
+	if name := sanitizeID(override); name != "" {
+		return name
+	}
+	return idPrefix + appName(icon)
+}
+
+// appName picks the most stable identifier available for the icon's
+// application: WM_CLASS, then executable name, then window id.
+func appName(icon *tray.Icon) string {
+	instance, class := icon.WMClass()
+	for _, candidate := range []string{instance, class, filepath.Base(icon.Executable())} {
+		if name := sanitizeID(candidate); name != "" {
+			return name
+		}
+	}
+	return fmt.Sprintf("%d", icon.Window)
+}
+
+// sanitizeID lowercases s and replaces everything but letters and digits with
+// single dashes, which keeps it valid both as an SNI id and in a bus name.
+func sanitizeID(s string) string {
+	s = strings.TrimSuffix(strings.ToLower(s), ".exe")
+	var b strings.Builder
+	dash := false
+	for _, r := range s {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+			continue
+		}
+		if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
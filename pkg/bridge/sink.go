@@ -0,0 +1,88 @@
+package bridge
+
+import (
+	"image"
+)
+
+// Sink publishes bridged icons. Its methods are called one at a time from the
+// loop of Run and must not block for long or call the Bridge, other than
+// Counts; the Icon passed in has what the sink needs.
+type Sink interface {
+	// IconAdded is called when an icon is bridged: it docked, or the
+	// configuration stopped ignoring it.
+	IconAdded(icon *Icon)
+	// IconChanged is called when the capture, title or attention state of
+	// an icon changed, or the configuration did. Changes may be coalesced.
+	IconChanged(icon *Icon)
+	// IconRemoved is called when an icon is no longer bridged, including
+	// when Run stops.
+	IconRemoved(icon *Icon)
+}
+
+// Icon is the state of a bridged icon when it was passed to a sink or
+// returned by Icons. It does not change afterwards.
+type Icon struct {
+	// ID is the stable id of the icon, such as "xtrayhide-discord". It is
+	// also its SNI id.
+	ID string
+	// Window is the X window id of the icon.
+	Window uint32
+	// Instance and Class are the WM_CLASS of the icon or its application.
+	Instance string
+	Class    string
+	Title    string
+	PID      uint32
+	// Executable and DesktopID identify the application when known.
+	Executable string
+	DesktopID  string
+	// IconName is a theme icon name for the icon, from the configuration
+	// or the application's desktop entry.
+	IconName string
+	// Image is the last capture of the icon, or the image set by the
+	// configuration. It is nil until the icon was captured and must not
+	// be modified.
+	Image image.Image
+	// NeedsAttention is set while the client sets the urgency hint.
+	NeedsAttention bool
+	// Category is the SNI category set by the configuration.
+	Category string
+
+	bridge *Bridge
+	entry  *iconEntry
+}
+
+// Click sends an X button to the icon, as clicking it in a tray would. Sinks
+// may call it; the click is sent from the loop of Run once the sink returned,
+// and dropped if the icon is no longer bridged by then.
+func (i *Icon) Click(button uint8) {
+	i.bridge.post(func() {
+		if i.entry.proxy != nil {
+			i.entry.proxy.Click(button)
+		}
+	})
+}
+
+// Callbacks is a sink calling the functions that are set.
+type Callbacks struct {
+	Added   func(icon *Icon)
+	Changed func(icon *Icon)
+	Removed func(icon *Icon)
+}
+
+func (c Callbacks) IconAdded(icon *Icon) {
+	if c.Added != nil {
+		c.Added(icon)
+	}
+}
+
+func (c Callbacks) IconChanged(icon *Icon) {
+	if c.Changed != nil {
+		c.Changed(icon)
+	}
+}
+
+func (c Callbacks) IconRemoved(icon *Icon) {
+	if c.Removed != nil {
+		c.Removed(icon)
+	}
+}
@@ -0,0 +1,146 @@
+package bridge
+
+import (
+	"image"
+
+	"github.com/godbus/dbus/v5"
+
+	"github.com/bnema/xtrayhide/internal/config"
+	"github.com/bnema/xtrayhide/internal/icontheme"
+	"github.com/bnema/xtrayhide/internal/proxy"
+	"github.com/bnema/xtrayhide/internal/sni"
+)
+
+// SNI returns a sink exporting icons as StatusNotifierItems on the session
+// bus, with their menu and actions, as the xtrayhide daemon does.
+func SNI() Sink {
+	return &sniSink{items: make(map[*iconEntry]*sniItem)}
+}
+
+type sniSink struct {
+	items map[*iconEntry]*sniItem
+}
+
+type sniItem struct {
+	item *sni.Item
+	bus  *dbus.Conn
+	// settings are those the item was last updated for.
+	settings config.Settings
+}
+
+func isSNI(s Sink) bool {
+	_, ok := s.(*sniSink)
+	return ok
+}
+
+func (s *sniSink) IconAdded(icon *Icon) {
+	entry := icon.entry
+	pixmap := []sni.Pixmap{}
+	switch img := entry.proxy.Image(); {
+	case len(entry.images) > 0:
+		pixmap = imagePixmaps(entry.images)
+	case img != nil:
+		pixmap = proxy.Pixmaps(img, entry.sizes)
+	case icon.IconName != "":
+		pixmap = themePixmaps(icon.IconName)
+	}
+
+	tooltip := sni.ToolTip{IconName: icon.IconName, Title: entry.app.Name}
+	if tooltip.Title == "" {
+		tooltip.Title = icon.Title
+	} else if tooltip.Title != icon.Title {
+		tooltip.Description = icon.Title
+	}
+	service := serviceName(icon.ID)
+	props := sni.Properties{
+		Category:   icon.Category,
+		ID:         icon.ID,
+		Title:      icon.Title,
+		Status:     "Active",
+		WindowID:   icon.Window,
+		IconName:   icon.IconName,
+		IconPixmap: pixmap,
+		ItemIsMenu: false,
+		ToolTip:    tooltip,
+	}
+
+	bus, err := sni.Connect()
+	if err != nil {
+		entry.log.Error("create SNI item failed", "service", service, "err", err)
+		return
+	}
+	item, err := sni.NewItem(bus, service, props, nil)
+	if err != nil {
+		entry.log.Error("create SNI item failed", "service", service, "err", err)
+		bus.Close()
+		return
+	}
+	entry.proxy.SetItem(item)
+	s.items[entry] = &sniItem{item: item, bus: bus, settings: entry.settings}
+	entry.log.Info("registered SNI item", "title", icon.Title, "service", service)
+}
+
+// IconChanged follows the configuration; the proxy publishes captures, titles
+// and attention to the item itself.
+func (s *sniSink) IconChanged(icon *Icon) {
+	it, ok := s.items[icon.entry]
+	if !ok {
+		return
+	}
+	previous, settings := it.settings, icon.entry.settings
+	it.settings = settings
+
+	it.item.UpdateCategory(settings.Category)
+	if settings.Icon != previous.Icon {
+		it.item.UpdateIconName(icon.IconName)
+		if images := icon.entry.images; len(images) > 0 {
+			it.item.UpdateIcon(imagePixmaps(images))
+		}
+	}
+	if settings.Title != previous.Title {
+		it.item.UpdateTitle(icon.Title)
+	}
+}
+
+func (s *sniSink) IconRemoved(icon *Icon) {
+	it, ok := s.items[icon.entry]
+	if !ok {
+		return
+	}
+	delete(s.items, icon.entry)
+	if icon.entry.proxy != nil {
+		icon.entry.proxy.SetItem(nil)
+	}
+	it.item.Close()
+	it.bus.Close()
+}
+
+// sniItem returns the item entry is exported as, if any.
+func (b *Bridge) sniItem(entry *iconEntry) *sni.Item {
+	for _, sink := range b.sinks {
+		if s, ok := sink.(*sniSink); ok {
+			if it, ok := s.items[entry]; ok {
+				return it.item
+			}
+		}
+	}
+	return nil
+}
+
+func imagePixmaps(images []image.Image) []sni.Pixmap {
+	pixmap := make([]sni.Pixmap, 0, len(images))
+	for _, img := range images {
+		pixmap = append(pixmap, sni.PixmapFromImage(img))
+	}
+	return pixmap
+}
+
+// themePixmaps renders the theme icon called name at the usual tray sizes,
+// for hosts that do not look up IconName themselves.
+func themePixmaps(name string) []sni.Pixmap {
+	pixmap := []sni.Pixmap{}
+	for _, img := range icontheme.Render(icontheme.Current(), name, icontheme.DefaultSizes) {
+		pixmap = append(pixmap, sni.PixmapFromImage(img))
+	}
+	return pixmap
+}